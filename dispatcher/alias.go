@@ -0,0 +1,84 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/logger"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/matcher/domain"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/policy"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/server"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// aliasRule answers queries that match the matcher as the target.
+type aliasRule struct {
+	matcher domain.MatcherGroup
+	target  string
+}
+
+func newAliasRule(c *config.AliasRule) (*aliasRule, error) {
+	target := dns.Fqdn(strings.ToLower(c.Target))
+	if _, ok := dns.IsDomainName(target); !ok || len(c.Target) == 0 {
+		return nil, fmt.Errorf("invalid target [%s]", c.Target)
+	}
+	if len(c.Domain) == 0 && len(c.File) == 0 {
+		return nil, fmt.Errorf("no domain")
+	}
+
+	mg, err := policy.LoadDomainMatchers(c.Domain, c.File)
+	if err != nil {
+		return nil, err
+	}
+	return &aliasRule{matcher: mg, target: target}, nil
+}
+
+// matchAlias returns the first alias rule that matches q, or nil.
+func (d *Dispatcher) matchAlias(q *dns.Msg) *aliasRule {
+	if len(d.alias) == 0 || len(q.Question) != 1 {
+		return nil
+	}
+
+	name := strings.ToLower(q.Question[0].Name)
+	for _, rule := range d.alias {
+		if rule.matcher.Match(name) && name != rule.target {
+			return rule
+		}
+	}
+	return nil
+}
+
+// dispatchAlias dispatches a query for the target of the rule and answers
+// q with a CNAME to the target and the target's answers.
+func (d *Dispatcher) dispatchAlias(ctx context.Context, p *profile, q *dns.Msg, meta *server.RequestMeta, rule *aliasRule) (*dns.Msg, error) {
+	logger.GetStd().Debugf("Dispatch: [%v %d] from %s: alias to %s", q.Question, q.Id, meta.ClientIP(), rule.target)
+
+	tq := q.Copy()
+	tq.Question[0].Name = rule.target
+	tr, err := d.dispatchQuery(ctx, p, tq, meta)
+	if err != nil {
+		return nil, fmt.Errorf("alias target %s: %w", rule.target, err)
+	}
+	if tr == nil {
+		return nil, nil
+	}
+	return d.synth.alias(q, tr, rule.target), nil
+}
@@ -26,40 +26,236 @@ import (
 // Config is config
 type Config struct {
 	Dispatcher struct {
-		Bind       []string `yaml:"bind"`
-		MaxUDPSize int      `yaml:"max_udp_size"`
+		Bind       []*BindConfig `yaml:"bind"`
+		MaxUDPSize int           `yaml:"max_udp_size"`
+
+		// Strategy can be "race"(default), "priority" or "sequential".
+		Strategy string `yaml:"strategy"`
+		// Grace is the time (ms) that "priority" waits for upstreams with a
+		// higher priority after the first accepted reply. 0 means always wait.
+		Grace uint `yaml:"grace"`
+		// Hedge is the time (ms) that "sequential" waits for an upstream
+		// before the query is sent to the next one. 0 means always wait.
+		Hedge uint `yaml:"hedge"`
+		// Sticky is the time (s) that the upstream which answered the last
+		// A/AAAA query of a domain is remembered. Other types of queries
+		// for the domain and its subdomains are sent to this upstream
+		// first. 0 means disabled.
+		Sticky uint `yaml:"sticky"`
+
+		// TrustedECS is a list of ip files. If a query comes from these
+		// clients (e.g. downstream forwarders) and has an ECS, the ECS
+		// address is used as the client address to match views.
+		TrustedECS []string `yaml:"trusted_ecs"`
 	} `yaml:"dispatcher"`
 
 	Upstream map[string]*UpstreamEntryConfig `yaml:"upstream"`
 	Server   map[string]*BasicUpstreamConfig `yaml:"server"`
 
-	IPSet struct {
-		CheckCNAME bool         `yaml:"check_cname"`
-		Mask4      uint8        `yaml:"mask4"`
-		Mask6      uint8        `yaml:"mask6"`
-		Rule       []*IPSetRule `yaml:"rule"`
-	} `yaml:"ipset"`
+	// Pipeline is the default pipeline of upstreams that don't have one.
+	Pipeline []*PipelineStep `yaml:"pipeline"`
+	// Sequences are named pipeline steps that pipelines can jump to.
+	Sequences map[string][]*PipelineStep `yaml:"sequences"`
+
+	// Forward sends queries for these domains to a server directly,
+	// before they are dispatched to upstreams.
+	Forward []*ForwardRule `yaml:"forward"`
+
+	// Alias answers queries for these domains with a CNAME to the target
+	// and the answers of the target. Queries for targets are dispatched as
+	// usual, but they are not aliased again.
+	Alias []*AliasRule `yaml:"alias"`
+
+	// Rebinding protects clients from dns rebinding attacks. It checks
+	// private, loopback, link-local and CGNAT addresses in replies from
+	// servers. Synthesized replies, e.g. blackhole, are not checked.
+	Rebinding struct {
+		// Mode can be "strip" (removes these addresses) or "reject" (replies
+		// REFUSED). Empty means disabled.
+		Mode string `yaml:"mode"`
+		// Domain is a list of domain suffixes that are allowed to have these
+		// addresses, e.g. "lan".
+		Domain []string `yaml:"domain"`
+		// File is a list of domain files that are allowed.
+		File []string `yaml:"file"`
+	} `yaml:"rebinding"`
+
+	// Consensus accepts an A/AAAA answer only if a quorum of upstreams agree.
+	Consensus struct {
+		// Domain is a domain policy. Only queries accepted by it use consensus.
+		// Empty means all queries.
+		Domain Policy `yaml:"domain"`
+		// Upstream is a list of upstream names.
+		Upstream []string `yaml:"upstream"`
+		// Quorum default is a majority of Upstream.
+		Quorum int `yaml:"quorum"`
+		// IP is a list of ip files. Replies that have addresses in the
+		// same file agree with each other.
+		IP []string `yaml:"ip"`
+		// Fallback is the tag of a trusted server.
+		Fallback string `yaml:"fallback"`
+		// Timeout (ms) waiting for the quorum. Default is 2000.
+		Timeout uint `yaml:"timeout"`
+	} `yaml:"consensus"`
+
+	IPSet IPSetConfig `yaml:"ipset"`
+
+	// TTL clamps ttls of answers before replies are sent to clients and
+	// added to ipset.
+	TTL struct {
+		// Min and Max are the bounds. 0 means no limit.
+		Min uint32 `yaml:"min"`
+		Max uint32 `yaml:"max"`
+		// Override uses other bounds for some domains. The first matched
+		// override is used.
+		Override []*TTLOverride `yaml:"override"`
+	} `yaml:"ttl"`
+
+	// Prober learns poisoned ips by sending queries to an address that runs
+	// no dns server, so any reply must be forged.
+	Prober struct {
+		// Sink is the address, e.g. "1.2.3.4:53".
+		Sink string `yaml:"sink"`
+		// Domains are names that are known to be poisoned.
+		Domains []string `yaml:"domains"`
+		// File persists the learned ips. Policies can use it as an ip file,
+		// which is updated by the prober at runtime.
+		File string `yaml:"file"`
+		// Interval (s) between probes. Default is 3600.
+		Interval uint `yaml:"interval"`
+		// Timeout (ms) waiting for forged replies of a query. Default is 2000.
+		Timeout uint `yaml:"timeout"`
+	} `yaml:"prober"`
+
+	// Synthesize configures replies from actions like nxdomain, nodata,
+	// refused, blackhole and Address_.
+	Synthesize struct {
+		// TTL of the answers. Default is 300.
+		TTL uint32 `yaml:"ttl"`
+		// SOA is added to the authority section of NXDOMAIN and NODATA
+		// replies, so clients can cache them. Its ttl is the same as TTL.
+		SOA struct {
+			MName string `yaml:"mname"`
+			RName string `yaml:"rname"`
+		} `yaml:"soa"`
+	} `yaml:"synthesize"`
+
+	// Profiles are named sets of upstreams and ipset rules that can be
+	// used by listeners.
+	Profiles map[string]*ProfileConfig `yaml:"profiles"`
+
+	// Views use different upstreams and ipset rules for different clients.
+	// Views are matched in order. Queries that don't match any view use
+	// the top-level upstream and ipset.
+	Views []*ViewConfig `yaml:"views"`
 
 	CA struct {
 		Path []string `yaml:"path"`
+
+		// UseSystem appends the CAs in Path to the system pool instead of replacing it.
+		UseSystem bool `yaml:"use_system"`
 	} `yaml:"ca"`
 }
 
 // UpstreamEntryConfig is a dns upstream.
 type UpstreamEntryConfig struct {
 	ServerTag string `yaml:"server"`
-	Policies  struct {
+	// Priority is used by "priority" and "sequential" strategies. Higher is preferred.
+	Priority int `yaml:"priority"`
+	// Timeout (ms) of the server. Queries that the server doesn't reply in
+	// time fail with a timeout error, so the error policy has time to
+	// redirect them. 0 means no limit.
+	Timeout  uint `yaml:"timeout"`
+	Policies struct {
 		Query struct {
+			Client           Policy `yaml:"client"`
+			QType            string `yaml:"qtype"`
 			UnhandlableTypes string `yaml:"unhandlable_types"`
-			Domain           string `yaml:"domain"`
+			Domain           Policy `yaml:"domain"`
 		} `yaml:"query"`
+		// Error maps errors to actions. Keys can be "timeout", "conn_refused",
+		// "tls", "other" (other transport errors), "servfail" and "refused".
+		Error map[string]string `yaml:"error"`
 		Reply struct {
+			// ErrorRcode is an action or a policy like "accept:NXDOMAIN|deny".
 			ErrorRcode string `yaml:"error_rcode"`
-			CNAME      string `yaml:"cname"`
-			WithoutIP  string `yaml:"without_ip"`
-			IP         string `yaml:"ip"`
+			// BogusIP is an ip policy like "nxdomain:./bogus_ip.list". A reply
+			// is bogus if any of its addresses is matched.
+			BogusIP   Policy `yaml:"bogus_ip"`
+			CNAME     Policy `yaml:"cname"`
+			WithoutIP string `yaml:"without_ip"`
+			IP        Policy `yaml:"ip"`
+			// IPMode decides how ip policies handle multiple addresses.
+			// Can be "first"(default), "any", "all" or "majority".
+			IPMode string `yaml:"ip_mode"`
+			// IPFinalNameOnly ignores addresses that don't belong to the final
+			// name of the CNAME chain.
+			IPFinalNameOnly bool `yaml:"ip_final_name_only"`
 		} `yaml:"reply"`
 	} `yaml:"policies"`
+
+	// Modify rewrites replies after they are accepted.
+	Modify struct {
+		// Address replaces answer addresses, e.g. "1.2.3.4: 5.6.7.8".
+		// Both addresses should be in the same family.
+		Address map[string]string `yaml:"address"`
+		// DropAAAA removes AAAA answers if the domain has A records.
+		DropAAAA bool `yaml:"drop_aaaa"`
+		// Minimal removes authority and additional sections.
+		Minimal bool `yaml:"minimal"`
+		// Rotate rotates the order of A and AAAA answers per query.
+		Rotate bool `yaml:"rotate"`
+		// Fastest sorts A and AAAA answers by their tcp connect latency.
+		// It can't be used with Rotate.
+		Fastest struct {
+			// Port of the probe, e.g. 443. 0 means disabled.
+			Port uint16 `yaml:"port"`
+			// Keep is the number of fastest reachable addresses to keep.
+			// 0 means all.
+			Keep int `yaml:"keep"`
+			// Timeout (ms) of a probe. Default is 500.
+			Timeout uint `yaml:"timeout"`
+			// CacheTTL (s) of probe results. Default is 600.
+			CacheTTL uint `yaml:"cache_ttl"`
+		} `yaml:"fastest"`
+	} `yaml:"modify"`
+
+	// Pipeline replaces the default steps of the upstream, which are
+	// client, qtype, unhandlable_types, domain, query, error_rcode, bogus_ip,
+	// cname, without_ip and ip. If a pipeline ends without an action, the
+	// current reply (can be nil) will be accepted.
+	Pipeline []*PipelineStep `yaml:"pipeline"`
+}
+
+// PipelineStep is a step of a pipeline. It should have one of Step,
+// Action, Forward, Goto and If.
+type PipelineStep struct {
+	// Step is a built-in step. Its policy is the one in the upstream's
+	// policies. "query" sends the query to the upstream's server.
+	Step string `yaml:"step"`
+	// Action ends the pipeline with the action.
+	Action string `yaml:"action"`
+	// Forward sends the query to the server with this tag. Its reply
+	// replaces the current reply.
+	Forward string `yaml:"forward"`
+	// Goto jumps to a named sequence. The pipeline ends with the sequence.
+	Goto string `yaml:"goto"`
+
+	If   *PipelineCondition `yaml:"if"`
+	Then []*PipelineStep    `yaml:"then"`
+	Else []*PipelineStep    `yaml:"else"`
+}
+
+// PipelineCondition matches if all of its keys match.
+type PipelineCondition struct {
+	QType  []string    `yaml:"qtype"`
+	Domain *PolicyRule `yaml:"domain"`
+	Client *PolicyRule `yaml:"client"`
+
+	// below keys don't match if there is no reply yet.
+	Rcode []string    `yaml:"rcode"`
+	HasIP *bool       `yaml:"has_ip"`
+	IP    *PolicyRule `yaml:"ip"` // matches if any address matches
 }
 
 // BasicUpstreamConfig is a basic config for a dns upstream.
@@ -68,6 +264,9 @@ type BasicUpstreamConfig struct {
 	Protocol string `yaml:"protocol"`
 	Socks5   string `yaml:"socks5"`
 
+	// FastOpen enables tcp fast open for tcp, dot and doh. linux only.
+	FastOpen bool `yaml:"fast_open"`
+
 	TCP struct {
 		IdleTimeout uint `yaml:"idle_timeout"`
 	} `yaml:"tcp"`
@@ -81,6 +280,39 @@ type BasicUpstreamConfig struct {
 		URL string `yaml:"url"`
 	} `yaml:"doh"`
 
+	// Warm keeps connections of tcp, dot and doh servers open, so queries
+	// don't have to wait for handshakes.
+	Warm struct {
+		// Conns is the number of connections to keep open. For doh,
+		// any value > 0 keeps its only http2 connection open.
+		Conns int `yaml:"conns"`
+		// Interval is the doh probe interval in seconds. Default is 30.
+		Interval uint `yaml:"interval"`
+	} `yaml:"warm"`
+
+	TLS struct {
+		// CA overwrites the global ca for this server.
+		CA          []string `yaml:"ca"`
+		UseSystemCA bool     `yaml:"use_system_ca"`
+
+		ClientCert string `yaml:"client_cert"`
+		ClientKey  string `yaml:"client_key"`
+
+		// PinSHA256 is a list of base64 encoded sha256 fingerprints of
+		// the server's public keys (SPKI).
+		PinSHA256 []string `yaml:"pin_sha256"`
+		// CertSHA256 is a list of hex encoded sha256 fingerprints of
+		// the server's certificates.
+		CertSHA256 []string `yaml:"cert_sha256"`
+
+		MinVersion string   `yaml:"min_version"`
+		ALPN       []string `yaml:"alpn"`
+
+		// SessionFile saves tls sessions to this file, so connections can be
+		// resumed after a restart.
+		SessionFile string `yaml:"session_file"`
+	} `yaml:"tls"`
+
 	// for test and experts only, we add `omitempty`
 	InsecureSkipVerify bool `yaml:"insecure_skip_verify,omitempty"`
 
@@ -92,13 +324,94 @@ type BasicUpstreamConfig struct {
 			Ipv6 string `yaml:"ipv6"`
 		} `yaml:"client_subnet"`
 		OverwriteECS bool `yaml:"overwrite_ecs"`
+
+		// TCPKeepAlive enables edns0 tcp keepalive (RFC 7828) for tcp and dot servers.
+		// The idle timeout will be adjusted automatically.
+		TCPKeepAlive bool `yaml:"tcp_keepalive"`
+
+		// Padding pads queries to dot and doh servers (RFC 7830) to a multiple
+		// of PaddingBlockSize. Default block size is 128 (RFC 8467).
+		Padding          bool `yaml:"padding"`
+		PaddingBlockSize int  `yaml:"padding_block_size"`
 	} `yaml:"edns0"`
 }
 
+// ForwardRule is a conditional forwarding zone.
+type ForwardRule struct {
+	// Domain is a list of domain suffixes, e.g. "lan", "168.192.in-addr.arpa".
+	Domain []string `yaml:"domain"`
+	// File is a list of domain files.
+	File []string `yaml:"file"`
+	// Server is the tag of the server.
+	Server string `yaml:"server"`
+}
+
+// AliasRule aliases domains to the target.
+type AliasRule struct {
+	// Domain is a list of domain suffixes.
+	Domain []string `yaml:"domain"`
+	// File is a list of domain files.
+	File []string `yaml:"file"`
+	// Target is the name that these domains resolve as.
+	Target string `yaml:"target"`
+}
+
+// TTLOverride clamps ttls of answers of these domains.
+type TTLOverride struct {
+	// Domain is a list of domain suffixes.
+	Domain []string `yaml:"domain"`
+	// File is a list of domain files.
+	File []string `yaml:"file"`
+	Min  uint32   `yaml:"min"`
+	Max  uint32   `yaml:"max"`
+}
+
+// BindConfig is a listen address like "udp://127.0.0.1:53". In yaml, it can
+// be a string or a map with keys "addr" and "profile".
+type BindConfig struct {
+	Addr string `yaml:"addr"`
+	// Profile is the name of the profile that the listener uses.
+	// Empty means the default profile (and views).
+	Profile string `yaml:"profile"`
+}
+
+func (c *BindConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		return value.Decode(&c.Addr)
+	}
+
+	type bindConfig BindConfig // avoid recursion
+	return value.Decode((*bindConfig)(c))
+}
+
+// ProfileConfig is a set of upstreams and ipset rules.
+type ProfileConfig struct {
+	Upstream map[string]*UpstreamEntryConfig `yaml:"upstream"`
+	IPSet    IPSetConfig                     `yaml:"ipset"`
+}
+
+// ViewConfig is a split-horizon view.
+type ViewConfig struct {
+	Name string `yaml:"name"`
+	// Client is a list of ip files. Queries from these clients use this view.
+	Client        []string `yaml:"client"`
+	ProfileConfig `yaml:",inline"`
+}
+
+type IPSetConfig struct {
+	CheckCNAME bool  `yaml:"check_cname"`
+	Mask4      uint8 `yaml:"mask4"`
+	Mask6      uint8 `yaml:"mask6"`
+	// Timeout adds entries with the ttl of their records as the timeout.
+	// Sets must be created with the timeout option.
+	Timeout bool         `yaml:"timeout"`
+	Rule    []*IPSetRule `yaml:"rule"`
+}
+
 type IPSetRule struct {
 	SetName4 string `yaml:"set_name4"`
 	SetName6 string `yaml:"set_name6"`
-	Domain   string `yaml:"domain"`
+	Domain   Policy `yaml:"domain"`
 }
 
 // LoadConfig loads a yaml config from path p.
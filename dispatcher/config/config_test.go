@@ -0,0 +1,86 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"testing"
+)
+
+func Test_BindConfig(t *testing.T) {
+	data := `
+bind:
+  - "udp://127.0.0.1:53"
+  - addr: "tcp://127.0.0.1:5353"
+    profile: "proxy"
+`
+	c := new(struct {
+		Bind []*BindConfig `yaml:"bind"`
+	})
+	if err := yaml.Unmarshal([]byte(data), c); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []*BindConfig{
+		{Addr: "udp://127.0.0.1:53"},
+		{Addr: "tcp://127.0.0.1:5353", Profile: "proxy"},
+	}
+	if !reflect.DeepEqual(c.Bind, want) {
+		t.Fatalf("want %v, got %v", want, c.Bind)
+	}
+}
+
+func Test_Policy(t *testing.T) {
+	data := `
+legacy: "accept:./list|deny"
+rules:
+  - action: accept
+    domains: ["cn"]
+    files: ["C:\\lists\\chn_domain.list"]
+  - action: deny
+`
+	c := new(struct {
+		Legacy Policy `yaml:"legacy"`
+		Rules  Policy `yaml:"rules"`
+	})
+	if err := yaml.Unmarshal([]byte(data), c); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Legacy.Legacy != "accept:./list|deny" || len(c.Legacy.Rules) != 0 {
+		t.Fatalf("unexpected legacy policy %v", c.Legacy)
+	}
+	want := []*PolicyRule{
+		{Action: "accept", Domains: []string{"cn"}, Files: []string{`C:\lists\chn_domain.list`}, Line: 4},
+		{Action: "deny", Line: 7},
+	}
+	if !reflect.DeepEqual(c.Rules.Rules, want) {
+		t.Fatalf("want %v, got %v", want, c.Rules.Rules)
+	}
+
+	for _, invalid := range []string{
+		"rules:\n  - action: accept\n    domain: [cn]\n", // typo
+		"rules:\n  - domains: [cn]\n",                    // no action
+		"rules:\n  a: b\n",                               // not a list
+	} {
+		if err := yaml.Unmarshal([]byte(invalid), c); err == nil {
+			t.Fatalf("invalid policy should be rejected: %s", invalid)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package config
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v3"
+)
+
+// Policy is a legacy policy string like "accept:./list|deny" or a list of
+// rules. In yaml, it can be a string or a sequence of PolicyRule.
+type Policy struct {
+	Legacy string
+	Rules  []*PolicyRule
+}
+
+// PolicyRule matches a query or a reply if any of its keys matches.
+// A rule without any key matches everything.
+type PolicyRule struct {
+	Action string `yaml:"action"`
+
+	// Files are domain or ip list files.
+	Files   []string `yaml:"files"`
+	Domains []string `yaml:"domains"`
+	CIDRs   []string `yaml:"cidrs"`
+	// GeoSite and GeoIP are v2ray dat files and tags like "./geosite.dat:cn".
+	GeoSite []string `yaml:"geosite"`
+	GeoIP   []string `yaml:"geoip"`
+
+	// Line is the line of the rule in the yaml file.
+	Line int `yaml:"-"`
+}
+
+var policyRuleKeys = map[string]struct{}{
+	"action":  {},
+	"files":   {},
+	"domains": {},
+	"cidrs":   {},
+	"geosite": {},
+	"geoip":   {},
+}
+
+// IsEmpty reports whether p has no policy.
+func (p *Policy) IsEmpty() bool {
+	return len(p.Legacy) == 0 && len(p.Rules) == 0
+}
+
+func (p *Policy) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		return value.Decode(&p.Legacy)
+	case yaml.SequenceNode:
+		for i, n := range value.Content {
+			if n.Kind != yaml.MappingNode {
+				return fmt.Errorf("line %d: policy rule #%d is not a map", n.Line, i)
+			}
+			for j := 0; j < len(n.Content); j += 2 {
+				if _, ok := policyRuleKeys[n.Content[j].Value]; !ok {
+					return fmt.Errorf("line %d: policy rule #%d has an unknown key [%s]", n.Content[j].Line, i, n.Content[j].Value)
+				}
+			}
+
+			rule := new(PolicyRule)
+			if err := n.Decode(rule); err != nil {
+				return fmt.Errorf("line %d: invalid policy rule #%d: %w", n.Line, i, err)
+			}
+			if len(rule.Action) == 0 {
+				return fmt.Errorf("line %d: policy rule #%d has no action", n.Line, i)
+			}
+			rule.Line = n.Line
+			p.Rules = append(p.Rules, rule)
+		}
+		return nil
+	default:
+		return fmt.Errorf("line %d: policy should be a string or a list of rules", value.Line)
+	}
+}
+
+func (p Policy) MarshalYAML() (interface{}, error) {
+	if len(p.Rules) != 0 {
+		return p.Rules, nil
+	}
+	return p.Legacy, nil
+}
@@ -0,0 +1,219 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/logger"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/matcher/netlist"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/policy"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/server"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/upstream"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/utils"
+	"github.com/miekg/dns"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultConsensusTimeout = time.Second * 2
+)
+
+// consensus sends A/AAAA queries to a set of entries and accepts an answer
+// only if a quorum of them agree. Otherwise, the query will be sent to
+// a trusted fallback server.
+type consensus struct {
+	domain   *policy.DomainPolicies // nil means all domains
+	entries  []int                  // index of Dispatcher.entriesSlice
+	quorum   int
+	lists    []netlist.Matcher // addresses in the same list are considered as the same
+	fallback upstream.Upstream
+	timeout  time.Duration
+
+	// statistics
+	agreed, disagreed uint64
+}
+
+func (d *Dispatcher) newConsensus(c *config.Config) (*consensus, error) {
+	cc := &c.Consensus
+	if len(cc.Upstream) == 0 {
+		return nil, nil
+	}
+
+	cs := new(consensus)
+	for _, name := range cc.Upstream {
+		idx := -1
+		for i := range d.entriesSlice {
+			if d.entriesSlice[i].name == name {
+				idx = i
+				break
+			}
+		}
+		if idx == -1 {
+			return nil, fmt.Errorf("can not find upstream [%s]", name)
+		}
+		cs.entries = append(cs.entries, idx)
+	}
+
+	cs.quorum = cc.Quorum
+	if cs.quorum == 0 {
+		cs.quorum = len(cs.entries)/2 + 1
+	}
+	if cs.quorum < 2 || cs.quorum > len(cs.entries) {
+		return nil, fmt.Errorf("invalid quorum %d, it should be in [2, %d]", cs.quorum, len(cs.entries))
+	}
+
+	if !cc.Domain.IsEmpty() {
+		p, err := policy.NewDomainPoliciesFromConfig(&cc.Domain, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load domain policies, %w", err)
+		}
+		cs.domain = p
+	}
+
+	for _, file := range cc.IP {
+		m, err := netlist.NewIPMatcherFromFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ip file from %s, %w", file, err)
+		}
+		cs.lists = append(cs.lists, m)
+	}
+
+	if len(cc.Fallback) == 0 {
+		return nil, errors.New("consensus needs a fallback server")
+	}
+	fallback, ok := d.servers[cc.Fallback]
+	if !ok {
+		return nil, fmt.Errorf("can not find server with tag [%s]", cc.Fallback)
+	}
+	cs.fallback = fallback
+
+	cs.timeout = defaultConsensusTimeout
+	if cc.Timeout > 0 {
+		cs.timeout = time.Duration(cc.Timeout) * time.Millisecond
+	}
+	return cs, nil
+}
+
+// match reports whether q should be dispatched by consensus.
+func (cs *consensus) match(q *dns.Msg) bool {
+	if isUnhandlableType(q) {
+		return false
+	}
+	if cs.domain == nil {
+		return true
+	}
+	action := cs.domain.Match(q.Question[0].Name)
+	return action != nil && action.Mode == policy.PolicyActionAccept
+}
+
+func (d *Dispatcher) dispatchConsensus(ctx context.Context, q *dns.Msg, meta *server.RequestMeta) (*dns.Msg, error) {
+	cs := d.consensus
+	resChan := make(chan *entryResult, len(cs.entries))
+	for _, idx := range cs.entries {
+		go d.exchangeEntry(ctx, &d.profile, idx, q, meta, resChan)
+	}
+
+	timer := utils.GetTimer(cs.timeout)
+	defer utils.ReleaseTimer(timer)
+
+	replies := make([]*entryResult, 0, len(cs.entries))
+wait:
+	for done := 0; done < len(cs.entries); done++ {
+		select {
+		case res := <-resChan:
+			if res.r == nil {
+				continue
+			}
+			replies = append(replies, res)
+			if winner := cs.agree(replies); winner != nil {
+				agreed := atomic.AddUint64(&cs.agreed, 1)
+				logger.GetStd().Debugf("Dispatch: [%v %d] from %s: consensus reached, use reply from upstream %s, agreed: %d, disagreed: %d", q.Question, q.Id, meta.ClientIP(), d.entriesSlice[winner.idx].name, agreed, atomic.LoadUint64(&cs.disagreed))
+				return winner.r, nil
+			}
+		case <-timer.C:
+			break wait
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	disagreed := atomic.AddUint64(&cs.disagreed, 1)
+	logger.GetStd().Infof("Dispatch: [%v %d] from %s: %d of %d upstreams replied but no consensus was reached, fall back to the trusted server, agreed: %d, disagreed: %d", q.Question, q.Id, meta.ClientIP(), len(replies), len(cs.entries), atomic.LoadUint64(&cs.agreed), disagreed)
+	r, err := cs.fallback.Exchange(ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("fallback server: %w", err)
+	}
+	return r, nil
+}
+
+// agree returns the reply with the highest priority from the replies
+// that have reached a quorum. Replies agree with each other if they have
+// a same address or have addresses in the same list.
+// agree returns nil if no quorum is reached.
+func (cs *consensus) agree(replies []*entryResult) *entryResult {
+	if len(replies) < cs.quorum {
+		return nil
+	}
+
+	addrVotes := make(map[string][]int) // addr -> index of replies
+	listVotes := make([][]int, len(cs.lists))
+	for i := range replies {
+		addrSeen := make(map[string]struct{})
+		listSeen := make([]bool, len(cs.lists))
+		for _, ip := range msgIPs(replies[i].r, "") {
+			key := string(ip.To16())
+			if _, ok := addrSeen[key]; !ok {
+				addrSeen[key] = struct{}{}
+				addrVotes[key] = append(addrVotes[key], i)
+			}
+			for li, l := range cs.lists {
+				if !listSeen[li] && l.Match(ip) {
+					listSeen[li] = true
+					listVotes[li] = append(listVotes[li], i)
+				}
+			}
+		}
+	}
+
+	best := -1
+	pick := func(votes []int) {
+		if len(votes) < cs.quorum {
+			return
+		}
+		for _, i := range votes {
+			if best == -1 || replies[i].idx < replies[best].idx {
+				best = i
+			}
+		}
+	}
+	for _, votes := range addrVotes {
+		pick(votes)
+	}
+	for _, votes := range listVotes {
+		pick(votes)
+	}
+
+	if best == -1 {
+		return nil
+	}
+	return replies[best]
+}
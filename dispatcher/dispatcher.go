@@ -23,13 +23,11 @@ import (
 	"errors"
 	"fmt"
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
-	"github.com/IrineSistiana/mos-chinadns/dispatcher/ipset"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/matcher/netlist"
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/server"
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/upstream"
-	"io/ioutil"
 	"net"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/logger"
@@ -41,10 +39,24 @@ import (
 type Dispatcher struct {
 	config *config.Config
 
-	servers      map[string]upstream.Upstream
-	entriesSlice []*upstreamEntry
+	servers  map[string]upstream.Upstream
+	profile  // default profile
+	profiles map[string]*profile
 
-	ipsetHandler *ipset.Handler
+	views      []*view
+	trustedECS netlist.MatcherGroup
+
+	synth     *synthesizer
+	forward   []*forwardRule
+	alias     []*aliasRule
+	sequences map[string]*sequence // built named sequences
+	prober    *prober
+	ttl       *ttlRewriter
+
+	strategy     strategy
+	grace, hedge time.Duration
+	consensus    *consensus
+	sticky       *stickyMemory
 }
 
 // InitDispatcher inits a dispatcher from configuration
@@ -54,10 +66,10 @@ func InitDispatcher(c *config.Config) (*Dispatcher, error) {
 
 	var rootCAs *x509.CertPool
 	var err error
-	if len(c.CA.Path) != 0 {
-		rootCAs, err = caPath2Pool(c.CA.Path)
+	if len(c.CA.Path) != 0 || c.CA.UseSystem {
+		rootCAs, err = upstream.NewCertPool(c.CA.Path, c.CA.UseSystem)
 		if err != nil {
-			return nil, fmt.Errorf("caPath2Pool: %w", err)
+			return nil, fmt.Errorf("NewCertPool: %w", err)
 		}
 		logger.GetStd().Info("initDispatcher: CA cert loaded")
 	}
@@ -75,23 +87,86 @@ func InitDispatcher(c *config.Config) (*Dispatcher, error) {
 		d.servers[tag] = server
 	}
 
-	if len(c.Upstream) == 0 {
-		return nil, fmt.Errorf("no upstream")
+	// only replies from servers are checked, synthesized replies, e.g.
+	// blackhole, are not.
+	rebinding, err := newRebindingFilter(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init rebinding filter: %w", err)
+	}
+	rebinding.wrap(d.servers)
+
+	d.synth = newSynthesizer(c)
+
+	// the prober registers its ip file, so it must be loaded before policies
+	d.prober, err = newProber(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init prober: %w", err)
+	}
+
+	p, err := d.newProfile("", &config.ProfileConfig{Upstream: c.Upstream, IPSet: c.IPSet})
+	if err != nil {
+		return nil, err
+	}
+	d.profile = *p
+
+	d.profiles = make(map[string]*profile)
+	for name, pc := range c.Profiles {
+		p, err := d.newProfile(name+"/", pc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init profile %s: %w", name, err)
+		}
+		d.profiles[name] = p
+	}
+
+	for _, vc := range c.Views {
+		v, err := d.newView(vc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init view: %w", err)
+		}
+		d.views = append(d.views, v)
+	}
+
+	for i, rc := range c.Alias {
+		rule, err := newAliasRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to init alias rule #%d: %w", i, err)
+		}
+		d.alias = append(d.alias, rule)
 	}
-	d.entriesSlice = make([]*upstreamEntry, 0, len(c.Upstream))
-	for name := range c.Upstream {
-		u, err := d.newEntry(name, c.Upstream[name])
+
+	d.ttl, err = newTTLRewriter(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init ttl rewriter: %w", err)
+	}
+
+	for i, rc := range c.Forward {
+		rule, err := d.newForwardRule(rc)
 		if err != nil {
-			return nil, fmt.Errorf("failed to init upstream %s: %w", name, err)
+			return nil, fmt.Errorf("failed to init forward rule #%d: %w", i, err)
 		}
-		d.entriesSlice = append(d.entriesSlice, u)
+		d.forward = append(d.forward, rule)
+	}
+
+	d.trustedECS, err = loadIPMatchers(c.Dispatcher.TrustedECS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load trusted ecs clients: %w", err)
+	}
+
+	d.strategy, err = parseStrategy(c.Dispatcher.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	d.grace = time.Duration(c.Dispatcher.Grace) * time.Millisecond
+	d.hedge = time.Duration(c.Dispatcher.Hedge) * time.Millisecond
+
+	if c.Dispatcher.Sticky > 0 {
+		d.sticky = newStickyMemory(time.Duration(c.Dispatcher.Sticky) * time.Second)
 	}
 
-	handler, err := ipset.NewIPSetHandler(c)
+	d.consensus, err = d.newConsensus(c)
 	if err != nil {
-		return nil, fmt.Errorf("failed to init ipset handler: %w", err)
+		return nil, fmt.Errorf("failed to init consensus: %w", err)
 	}
-	d.ipsetHandler = handler
 
 	return d, nil
 }
@@ -99,8 +174,12 @@ func InitDispatcher(c *config.Config) (*Dispatcher, error) {
 // ServeDNS sends q to upstreams and return its first valid result.
 // ServeDNS will add r's IPs to ipset.
 // If all upstreams failed, ServeDNS will return a r with r.Code = dns.RcodeServerFailure
-func (d *Dispatcher) ServeDNS(ctx context.Context, q *dns.Msg) (r *dns.Msg, err error) {
-	r, err = d.Dispatch(ctx, q)
+func (d *Dispatcher) ServeDNS(ctx context.Context, q *dns.Msg, meta *server.RequestMeta) (r *dns.Msg, err error) {
+	return d.serveDNS(ctx, d.selectProfile(q, meta), q, meta)
+}
+
+func (d *Dispatcher) serveDNS(ctx context.Context, p *profile, q *dns.Msg, meta *server.RequestMeta) (r *dns.Msg, err error) {
+	r, err = d.dispatch(ctx, p, q, meta)
 	if err != nil {
 		if errors.Is(err, ErrUpstreamsFailed) {
 			r = new(dns.Msg)
@@ -110,8 +189,13 @@ func (d *Dispatcher) ServeDNS(ctx context.Context, q *dns.Msg) (r *dns.Msg, err
 		return r, err
 	}
 
-	if d.ipsetHandler != nil {
-		err := d.ipsetHandler.ApplyIPSet(q, r)
+	// ttls are clamped before they are used as ipset timeouts
+	if d.ttl != nil && r != nil {
+		d.ttl.rewrite(q, r)
+	}
+
+	if p.ipsetHandler != nil {
+		err := p.ipsetHandler.ApplyIPSet(q, r)
 		if err != nil {
 			logger.GetStd().Warnf("ServeDNS: [%v %d]: ipset handler: %v", q.Question, q.Id, err)
 		}
@@ -124,57 +208,53 @@ var (
 	ErrUpstreamsFailed = errors.New("all upstreams failed or not respond in time")
 )
 
-// Dispatch sends q to upstreams and return its first valid result.
-func (d *Dispatcher) Dispatch(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
-	resChan := make(chan *dns.Msg, 1)
-	upstreamWG := sync.WaitGroup{}
-	for i := range d.entriesSlice {
-		entry := d.entriesSlice[i]
+// Dispatch sends q to upstreams and return its result according to the dispatch strategy.
+// Queries that are still in flight will be cancelled when Dispatch returns.
+// meta can be nil if q doesn't come from a client.
+func (d *Dispatcher) Dispatch(ctx context.Context, q *dns.Msg, meta *server.RequestMeta) (*dns.Msg, error) {
+	return d.dispatch(ctx, d.selectProfile(q, meta), q, meta)
+}
 
-		upstreamWG.Add(1)
-		go func() {
-			defer upstreamWG.Done()
+func (d *Dispatcher) dispatch(ctx context.Context, p *profile, q *dns.Msg, meta *server.RequestMeta) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-			queryStart := time.Now()
-			r, err := entry.Exchange(ctx, q)
-			rtt := time.Since(queryStart).Milliseconds()
-			if err != nil {
-				if err != context.Canceled && err != context.DeadlineExceeded {
-					logger.GetStd().Warnf("Dispatch: [%v %d]: upstream %s err after %dms: %v,", q.Question, q.Id, entry.name, rtt, err)
-				}
-				return
-			}
+	if rule := d.matchAlias(q); rule != nil {
+		return d.dispatchAlias(ctx, p, q, meta, rule)
+	}
+	return d.dispatchQuery(ctx, p, q, meta)
+}
 
-			if r != nil {
-				logger.GetStd().Debugf("Dispatch: [%v %d]: reply from upstream %s accepted, rtt: %dms", q.Question, q.Id, entry.name, rtt)
-				select {
-				case resChan <- r:
-				default:
-				}
-			}
-		}()
+// dispatchQuery dispatches q without alias rules.
+func (d *Dispatcher) dispatchQuery(ctx context.Context, p *profile, q *dns.Msg, meta *server.RequestMeta) (*dns.Msg, error) {
+	if rule := d.matchForward(q); rule != nil {
+		logger.GetStd().Debugf("Dispatch: [%v %d] from %s: forward to server %s", q.Question, q.Id, meta.ClientIP(), rule.tag)
+		r, err := rule.server.Exchange(ctx, q)
+		if err != nil {
+			return nil, fmt.Errorf("forward server %s: %w", rule.tag, err)
+		}
+		return r, nil
+	}
+
+	// consensus only uses entries from the default profile
+	if d.consensus != nil && p == &d.profile && d.consensus.match(q) {
+		return d.dispatchConsensus(ctx, q, meta)
 	}
-	upstreamFailedNotificationChan := make(chan struct{}, 0)
-
-	// this go routine notifies the Dispatch if all upstreams are failed
-	go func() {
-		// all upstreams are returned
-		upstreamWG.Wait()
-		// avoid below select{} choose upstreamFailedNotificationChan
-		// if both resChan and upstreamFailedNotificationChan are selectable
-		if len(resChan) == 0 {
-			close(upstreamFailedNotificationChan)
+
+	if d.sticky != nil && isUnhandlableType(q) {
+		if r := d.dispatchSticky(ctx, p, q, meta); r != nil {
+			return r, nil
 		}
-	}()
-
-	select {
-	case m := <-resChan:
-		return m, nil
-	case <-upstreamFailedNotificationChan:
-		return nil, ErrUpstreamsFailed
-	case <-ctx.Done():
-		return nil, ctx.Err()
 	}
+
+	res, err := d.dispatchStrategy(ctx, p, q, meta)
+	if err != nil {
+		return nil, err
+	}
+	if d.sticky != nil && !isUnhandlableType(q) {
+		d.sticky.remember(p, q.Question[0].Name, res.idx)
+	}
+	return res.r, nil
 }
 
 // StartServer starts mos-chinadns. Will always return a non-nil err.
@@ -186,14 +266,27 @@ func (d *Dispatcher) StartServer() error {
 
 	errChan := make(chan error, 1) // must be a buffered chan to catch at least one err.
 
-	for _, s := range d.config.Dispatcher.Bind {
-		ss := strings.Split(s, "://")
+	if d.prober != nil {
+		go d.prober.run()
+	}
+
+	for _, bc := range d.config.Dispatcher.Bind {
+		ss := strings.Split(bc.Addr, "://")
 		if len(ss) != 2 {
-			return fmt.Errorf("invalid bind address: %s", s)
+			return fmt.Errorf("invalid bind address: %s", bc.Addr)
 		}
 		network := ss[0]
 		addr := ss[1]
 
+		var h server.Handler = d
+		if len(bc.Profile) != 0 {
+			p, ok := d.profiles[bc.Profile]
+			if !ok {
+				return fmt.Errorf("can not find profile [%s] for bind address %s", bc.Profile, bc.Addr)
+			}
+			h = &profileHandler{d: d, p: p}
+		}
+
 		var s server.Server
 		switch network {
 		case "tcp", "tcp4", "tcp6":
@@ -226,7 +319,7 @@ func (d *Dispatcher) StartServer() error {
 		}
 
 		go func() {
-			err := s.ListenAndServe(d)
+			err := s.ListenAndServe(h)
 			select {
 			case errChan <- err:
 			default:
@@ -238,19 +331,3 @@ func (d *Dispatcher) StartServer() error {
 
 	return fmt.Errorf("server listener failed and exited: %w", listenerErr)
 }
-
-func caPath2Pool(cas []string) (*x509.CertPool, error) {
-	rootCAs := x509.NewCertPool()
-
-	for _, ca := range cas {
-		pem, err := ioutil.ReadFile(ca)
-		if err != nil {
-			return nil, fmt.Errorf("ReadFile: %w", err)
-		}
-
-		if ok := rootCAs.AppendCertsFromPEM(pem); !ok {
-			return nil, fmt.Errorf("AppendCertsFromPEM: no certificate was successfully parsed in %s", ca)
-		}
-	}
-	return rootCAs, nil
-}
@@ -19,6 +19,12 @@ package dispatcher
 
 import (
 	"context"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/ecs"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/matcher/netlist"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/policy"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/server"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/upstream"
 	"net"
 	"testing"
 	"time"
@@ -38,7 +44,7 @@ func Test_dispatch(t *testing.T) {
 	d.entriesSlice = append(d.entriesSlice, &upstreamEntry{backend: &fakeUpstream{latency: time.Millisecond * 0, ip: u1ip}})
 	d.entriesSlice = append(d.entriesSlice, &upstreamEntry{backend: &fakeUpstream{latency: time.Millisecond * 300, ip: u2ip}})
 
-	r, err := d.Dispatch(context.Background(), q)
+	r, err := d.Dispatch(context.Background(), q, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -48,6 +54,338 @@ func Test_dispatch(t *testing.T) {
 	}
 }
 
+func Test_dispatch_strategy(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	slowIP := net.ParseIP("1.2.3.4")
+	fastIP := net.ParseIP("4.3.2.1")
+	newDispatcher := func(st strategy, grace, hedge time.Duration) *Dispatcher {
+		d := new(Dispatcher)
+		d.strategy = st
+		d.grace = grace
+		d.hedge = hedge
+		d.entriesSlice = []*upstreamEntry{
+			{name: "slow", backend: &fakeUpstream{latency: time.Millisecond * 100, ip: slowIP}},
+			{name: "fast", backend: &fakeUpstream{latency: 0, ip: fastIP}},
+		}
+		return d
+	}
+
+	tests := []struct {
+		name string
+		d    *Dispatcher
+		want net.IP
+	}{
+		{"race", newDispatcher(strategyRace, 0, 0), fastIP},
+		{"priority in grace", newDispatcher(strategyPriority, time.Millisecond*300, 0), slowIP},
+		{"priority out of grace", newDispatcher(strategyPriority, time.Millisecond*20, 0), fastIP},
+		{"priority no grace", newDispatcher(strategyPriority, 0, 0), slowIP},
+		{"sequential", newDispatcher(strategySequential, 0, 0), slowIP},
+		{"sequential hedged", newDispatcher(strategySequential, 0, time.Millisecond*20), fastIP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := tt.d.Dispatch(context.Background(), q, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Answer[0].(*dns.A).A; !got.Equal(tt.want) {
+				t.Fatalf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_dispatch_consensus(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	goodIP := net.ParseIP("1.2.3.4")
+	badIP := net.ParseIP("4.3.2.1")
+	fallbackIP := net.ParseIP("8.8.8.8")
+
+	newDispatcher := func(quorum int, ips ...net.IP) *Dispatcher {
+		d := new(Dispatcher)
+		cs := &consensus{quorum: quorum, timeout: time.Second, fallback: &fakeUpstream{ip: fallbackIP}}
+		for i, ip := range ips {
+			d.entriesSlice = append(d.entriesSlice, &upstreamEntry{backend: &fakeUpstream{latency: time.Millisecond * time.Duration(i*10), ip: ip}})
+			cs.entries = append(cs.entries, i)
+		}
+		d.consensus = cs
+		return d
+	}
+
+	tests := []struct {
+		name string
+		d    *Dispatcher
+		want net.IP
+	}{
+		{"agreed", newDispatcher(2, badIP, goodIP, goodIP), goodIP},
+		{"disagreed", newDispatcher(2, badIP, goodIP, net.ParseIP("5.6.7.8")), fallbackIP},
+		{"quorum not reached", newDispatcher(3, goodIP, goodIP, badIP), fallbackIP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := tt.d.Dispatch(context.Background(), q, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Answer[0].(*dns.A).A; !got.Equal(tt.want) {
+				t.Fatalf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_dispatch_client(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	defaultIP := net.ParseIP("1.2.3.4")
+	guestIP := net.ParseIP("4.3.2.1")
+	servers := map[string]upstream.Upstream{"guest": &fakeUpstream{ip: guestIP}}
+	p, err := policy.NewIPPolicies("Redirect_guest:./testdata/ip.list", servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := new(Dispatcher)
+	entry := &upstreamEntry{backend: &fakeUpstream{ip: defaultIP}}
+	entry.policies.query.client = p
+	d.entriesSlice = []*upstreamEntry{entry}
+
+	tests := []struct {
+		name string
+		meta *server.RequestMeta
+		want net.IP
+	}{
+		{"no meta", nil, defaultIP},
+		{"guest", &server.RequestMeta{ClientAddr: &net.UDPAddr{IP: net.ParseIP("1.0.0.1"), Port: 53}}, guestIP},
+		{"others", &server.RequestMeta{ClientAddr: &net.TCPAddr{IP: net.ParseIP("12.0.0.1"), Port: 53}}, defaultIP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := d.Dispatch(context.Background(), q, tt.meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Answer[0].(*dns.A).A; !got.Equal(tt.want) {
+				t.Fatalf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_dispatch_view(t *testing.T) {
+	defaultIP := net.ParseIP("1.2.3.4")
+	viewIP := net.ParseIP("4.3.2.1")
+	forwarder := net.ParseIP("192.168.1.1")
+
+	clients, err := loadIPMatchers([]string{"./testdata/ip.list"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarderNet, err := netlist.ParseCIDR(forwarder.String() + "/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarders := netlist.NewNetList()
+	forwarders.Append(forwarderNet)
+	forwarders.Sort()
+
+	d := new(Dispatcher)
+	d.entriesSlice = []*upstreamEntry{{backend: &fakeUpstream{ip: defaultIP}}}
+	d.views = []*view{{name: "view", clients: clients, profile: &profile{entriesSlice: []*upstreamEntry{{backend: &fakeUpstream{ip: viewIP}}}}}}
+	d.trustedECS = netlist.MatcherGroup{forwarders}
+
+	newQuery := func(ecsAddr string) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		if len(ecsAddr) != 0 {
+			e, err := ecs.NewEDNS0SubnetFromStr(ecsAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ecs.SetECS(q, e)
+		}
+		return q
+	}
+	newMeta := func(ip string) *server.RequestMeta {
+		return &server.RequestMeta{ClientAddr: &net.UDPAddr{IP: net.ParseIP(ip), Port: 53}}
+	}
+
+	tests := []struct {
+		name string
+		q    *dns.Msg
+		meta *server.RequestMeta
+		want net.IP
+	}{
+		{"no meta", newQuery(""), nil, defaultIP},
+		{"in view", newQuery(""), newMeta("1.0.0.1"), viewIP},
+		{"not in view", newQuery(""), newMeta("12.0.0.1"), defaultIP},
+		{"untrusted ecs", newQuery("1.0.0.1/32"), newMeta("12.0.0.1"), defaultIP},
+		{"trusted ecs", newQuery("1.0.0.1/32"), newMeta(forwarder.String()), viewIP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := d.Dispatch(context.Background(), tt.q, tt.meta)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Answer[0].(*dns.A).A; !got.Equal(tt.want) {
+				t.Fatalf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_profileHandler(t *testing.T) {
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+
+	defaultIP := net.ParseIP("1.2.3.4")
+	profileIP := net.ParseIP("4.3.2.1")
+
+	d := new(Dispatcher)
+	d.entriesSlice = []*upstreamEntry{{backend: &fakeUpstream{ip: defaultIP}}}
+	h := &profileHandler{d: d, p: &profile{entriesSlice: []*upstreamEntry{{backend: &fakeUpstream{ip: profileIP}}}}}
+
+	r, err := h.ServeDNS(context.Background(), q, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Answer[0].(*dns.A).A; !got.Equal(profileIP) {
+		t.Fatalf("want %s, got %s", profileIP, got)
+	}
+}
+
+func Test_dispatch_forward(t *testing.T) {
+	defaultIP := net.ParseIP("1.2.3.4")
+	lanIP := net.ParseIP("192.168.1.1")
+
+	d := new(Dispatcher)
+	d.servers = map[string]upstream.Upstream{"lan": &fakeUpstream{ip: lanIP}}
+	d.entriesSlice = []*upstreamEntry{{backend: &fakeUpstream{ip: defaultIP}}}
+	rule, err := d.newForwardRule(&config.ForwardRule{Domain: []string{"lan", "168.192.in-addr.arpa"}, Server: "lan"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.forward = []*forwardRule{rule}
+
+	tests := []struct {
+		name string
+		want net.IP
+	}{
+		{"lan.", lanIP},
+		{"router.LAN.", lanIP},
+		{"1.1.168.192.in-addr.arpa.", lanIP},
+		{"example.com.", defaultIP},
+		{"lan.example.com.", defaultIP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := new(dns.Msg)
+			q.SetQuestion(tt.name, dns.TypeA)
+			r, err := d.Dispatch(context.Background(), q, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Answer[0].(*dns.A).A; !got.Equal(tt.want) {
+				t.Fatalf("want %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_dispatch_alias(t *testing.T) {
+	targetIP := net.ParseIP("1.2.3.4")
+
+	d := new(Dispatcher)
+	d.entriesSlice = []*upstreamEntry{{backend: funcUpstream(func(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+		r := new(dns.Msg)
+		r.SetReply(q)
+		if q.Question[0].Name != "www.google.com." {
+			r.Rcode = dns.RcodeNameError
+			return r, nil
+		}
+		r.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: targetIP}}
+		return r, nil
+	})}}
+	for _, rc := range []*config.AliasRule{
+		{Domain: []string{"www.google.cn"}, Target: "www.google.com"},
+		{Domain: []string{"com"}, Target: "www.google.com"}, // targets are not aliased again
+	} {
+		rule, err := newAliasRule(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.alias = append(d.alias, rule)
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion("www.google.cn.", dns.TypeA)
+	r, err := d.Dispatch(context.Background(), q, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Rcode != dns.RcodeSuccess || r.Question[0].Name != "www.google.cn." || len(r.Answer) != 2 {
+		t.Fatalf("unexpected reply %v", r)
+	}
+	if cname, ok := r.Answer[0].(*dns.CNAME); !ok || cname.Hdr.Name != "www.google.cn." || cname.Target != "www.google.com." {
+		t.Fatalf("want a cname to the target, got %v", r.Answer[0])
+	}
+	if a, ok := r.Answer[1].(*dns.A); !ok || !a.A.Equal(targetIP) {
+		t.Fatalf("want the answer of the target, got %v", r.Answer[1])
+	}
+
+	if _, err := newAliasRule(&config.AliasRule{Domain: []string{"a"}}); err == nil {
+		t.Fatal("rule without target should be rejected")
+	}
+}
+
+func Test_dispatch_sticky(t *testing.T) {
+	slowIP := net.ParseIP("1.2.3.4")
+	fastIP := net.ParseIP("4.3.2.1")
+
+	denyA, err := policy.NewQtypePolicies("deny:A", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := new(Dispatcher)
+	d.entriesSlice = []*upstreamEntry{
+		{name: "fast", backend: &fakeUpstream{latency: 0, ip: fastIP}},
+		{name: "slow", backend: &fakeUpstream{latency: time.Millisecond * 50, ip: slowIP}},
+	}
+	d.entriesSlice[0].policies.query.qtype = denyA // A queries are answered by the slow one
+	d.sticky = newStickyMemory(time.Minute)
+
+	exchange := func(name string, qtype uint16) net.IP {
+		q := new(dns.Msg)
+		q.SetQuestion(name, qtype)
+		r, err := d.Dispatch(context.Background(), q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r.Answer[0].(*dns.A).A
+	}
+
+	if got := exchange("www.example.com.", dns.TypeTXT); !got.Equal(fastIP) {
+		t.Fatalf("without memory, want the first reply %s, got %s", fastIP, got)
+	}
+	if got := exchange("example.com.", dns.TypeA); !got.Equal(slowIP) {
+		t.Fatalf("want A reply %s, got %s", slowIP, got)
+	}
+	for _, name := range []string{"example.com.", "www.EXAMPLE.com."} {
+		if got := exchange(name, dns.TypeTXT); !got.Equal(slowIP) {
+			t.Fatalf("%s: want the remembered upstream %s, got %s", name, slowIP, got)
+		}
+	}
+	if got := exchange("example.org.", dns.TypeTXT); !got.Equal(fastIP) {
+		t.Fatalf("other domains should not be affected, got %s", got)
+	}
+}
+
 type fakeUpstream struct {
 	latency time.Duration
 	ip      net.IP
@@ -46,6 +46,21 @@ func CheckMsgHasECS(m *dns.Msg) bool {
 	return false
 }
 
+// GetECS returns the ECS of m, or nil if m doesn't have one.
+func GetECS(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for o := range opt.Option {
+		if ecs, ok := opt.Option[o].(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
 func SetECS(m *dns.Msg, ecs *dns.EDNS0_SUBNET) *dns.Msg {
 	opt := m.IsEdns0()
 	if opt == nil { // no opt, we need a new opt
@@ -0,0 +1,106 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/policy"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/upstream"
+	"github.com/miekg/dns"
+	"net"
+	"syscall"
+)
+
+const (
+	errKindTimeout     = "timeout"
+	errKindConnRefused = "conn_refused"
+	errKindTLS         = "tls"
+	errKindOther       = "other"
+	errKindServfail    = "servfail"
+	errKindRefused     = "refused"
+)
+
+var transportErrKinds = map[string]bool{
+	errKindTimeout:     true,
+	errKindConnRefused: true,
+	errKindTLS:         true,
+	errKindOther:       true,
+	errKindServfail:    false,
+	errKindRefused:     false,
+}
+
+// errorPolicy maps errors of an upstream to actions.
+// A nil errorPolicy matches nothing.
+type errorPolicy struct {
+	actions map[string]*policy.Action
+}
+
+func newErrorPolicy(m map[string]string, servers map[string]upstream.Upstream) (*errorPolicy, error) {
+	p := &errorPolicy{actions: make(map[string]*policy.Action)}
+	for kind, s := range m {
+		isTransport, ok := transportErrKinds[kind]
+		if !ok {
+			return nil, fmt.Errorf("invalid error type [%s]", kind)
+		}
+		action, err := policy.NewAction(s, servers)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s action [%s]: %w", kind, s, err)
+		}
+		if isTransport && action.Mode == policy.PolicyActionAccept {
+			return nil, fmt.Errorf("%s has no reply to accept", kind)
+		}
+		p.actions[kind] = action
+	}
+	return p, nil
+}
+
+func (p *errorPolicy) match(kind string) *policy.Action {
+	if p == nil {
+		return nil
+	}
+	return p.actions[kind]
+}
+
+// errorKind returns the kind of a transport error.
+func errorKind(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errKindConnRefused
+	case errors.Is(err, upstream.ErrTLSHandshake):
+		return errKindTLS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return errKindTimeout
+	default:
+		return errKindOther
+	}
+}
+
+// rcodeKind returns the kind of an error rcode, or "" if it doesn't have one.
+func rcodeKind(rcode int) string {
+	switch rcode {
+	case dns.RcodeServerFailure:
+		return errKindServfail
+	case dns.RcodeRefused:
+		return errKindRefused
+	default:
+		return ""
+	}
+}
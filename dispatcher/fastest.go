@@ -0,0 +1,171 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/logger"
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFastestTimeout  = time.Millisecond * 500
+	defaultFastestCacheTTL = time.Minute * 10
+)
+
+// fastestIP sorts addresses in replies by their tcp connect latency.
+// Probe results are cached per address, and addresses that are not probed
+// yet are probed in background, so probes don't delay replies.
+type fastestIP struct {
+	port     string
+	keep     int
+	timeout  time.Duration
+	cacheTTL time.Duration
+
+	sync.Mutex
+	results   map[string]*probeResult // key is net.IP.String()
+	lastSweep time.Time
+}
+
+type probeResult struct {
+	probing   bool
+	reachable bool
+	rtt       time.Duration
+	expire    time.Time
+}
+
+// newFastestIP returns nil if it is disabled.
+func newFastestIP(uc *config.UpstreamEntryConfig) *fastestIP {
+	fc := &uc.Modify.Fastest
+	if fc.Port == 0 {
+		return nil
+	}
+
+	f := &fastestIP{
+		port:     strconv.Itoa(int(fc.Port)),
+		keep:     fc.Keep,
+		timeout:  defaultFastestTimeout,
+		cacheTTL: defaultFastestCacheTTL,
+		results:  make(map[string]*probeResult),
+	}
+	if fc.Timeout > 0 {
+		f.timeout = time.Duration(fc.Timeout) * time.Millisecond
+	}
+	if fc.CacheTTL > 0 {
+		f.cacheTTL = time.Duration(fc.CacheTTL) * time.Second
+	}
+	return f
+}
+
+type probedRR struct {
+	rr dns.RR
+	*probeResult
+}
+
+// sort sorts A and AAAA answers in r, reachable and fast ones first. If
+// any of the addresses has no probe result yet, r is not changed.
+func (f *fastestIP) sort(r *dns.Msg) {
+	var others []dns.RR
+	var rrs []probedRR
+	var toProbe []string
+	unknown := false
+
+	now := time.Now()
+	f.Lock()
+	for _, rr := range r.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			others = append(others, rr)
+			continue
+		}
+
+		key := ip.String()
+		res, ok := f.results[key]
+		if !ok || now.After(res.expire) {
+			res = &probeResult{probing: true, expire: now.Add(f.timeout * 2)}
+			f.results[key] = res
+			toProbe = append(toProbe, key)
+		}
+		if res.probing {
+			unknown = true
+		}
+		rrs = append(rrs, probedRR{rr: rr, probeResult: res})
+	}
+	f.Unlock()
+
+	for _, ip := range toProbe {
+		go f.probe(ip)
+	}
+	if unknown || len(rrs) == 0 {
+		return
+	}
+
+	sort.SliceStable(rrs, func(i, j int) bool {
+		if rrs[i].reachable != rrs[j].reachable {
+			return rrs[i].reachable
+		}
+		return rrs[i].rtt < rrs[j].rtt
+	})
+	if f.keep > 0 && rrs[0].reachable {
+		n := 0
+		for n < len(rrs) && n < f.keep && rrs[n].reachable {
+			n++
+		}
+		rrs = rrs[:n]
+	}
+
+	r.Answer = others
+	for _, prr := range rrs {
+		r.Answer = append(r.Answer, prr.rr)
+	}
+}
+
+func (f *fastestIP) probe(ip string) {
+	start := time.Now()
+	c, err := net.DialTimeout("tcp", net.JoinHostPort(ip, f.port), f.timeout)
+	rtt := time.Since(start)
+	if err == nil {
+		c.Close()
+	} else {
+		logger.GetStd().Debugf("fastestIP: %s is unreachable: %v", ip, err)
+	}
+
+	now := time.Now()
+	f.Lock()
+	defer f.Unlock()
+	f.results[ip] = &probeResult{reachable: err == nil, rtt: rtt, expire: now.Add(f.cacheTTL)}
+
+	if now.Sub(f.lastSweep) > f.cacheTTL {
+		f.lastSweep = now
+		for key, res := range f.results {
+			if now.After(res.expire) {
+				delete(f.results, key)
+			}
+		}
+	}
+}
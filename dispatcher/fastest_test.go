@@ -0,0 +1,75 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_fastestIP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	uc := new(config.UpstreamEntryConfig)
+	uc.Modify.Fastest.Port = uint16(l.Addr().(*net.TCPAddr).Port)
+	uc.Modify.Fastest.Keep = 1
+	f := newFastestIP(uc)
+
+	newReply := func() *dns.Msg {
+		r := new(dns.Msg)
+		r.SetQuestion("example.com.", dns.TypeA)
+		r.Answer = []dns.RR{&dns.CNAME{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET}, Target: "cdn.example.com."}}
+		for i := 2; i > 0; i-- { // 127.0.0.2 doesn't accept connections
+			ip := net.ParseIP("127.0.0." + strconv.Itoa(i))
+			r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: "cdn.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: ip})
+		}
+		return r
+	}
+
+	// the first reply is not changed, its addresses are probed in background
+	r := newReply()
+	f.sort(r)
+	if len(r.Answer) != 3 || !r.Answer[1].(*dns.A).A.Equal(net.ParseIP("127.0.0.2")) {
+		t.Fatalf("the first reply should not be changed, got %v", r.Answer)
+	}
+
+	deadline := time.Now().Add(time.Second * 2)
+	for {
+		r = newReply()
+		f.sort(r)
+		if len(r.Answer) != 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("addresses are not probed in time")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if len(r.Answer) != 2 || r.Answer[0].Header().Rrtype != dns.TypeCNAME || !r.Answer[1].(*dns.A).A.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("want the cname and the reachable address, got %v", r.Answer)
+	}
+}
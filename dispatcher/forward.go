@@ -0,0 +1,68 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/matcher/domain"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/policy"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/upstream"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// forwardRule sends queries that match the matcher to the server.
+type forwardRule struct {
+	matcher domain.Matcher
+	tag     string
+	server  upstream.Upstream
+}
+
+func (d *Dispatcher) newForwardRule(c *config.ForwardRule) (*forwardRule, error) {
+	if len(c.Domain) == 0 && len(c.File) == 0 {
+		return nil, errors.New("no domain")
+	}
+
+	mg, err := policy.LoadDomainMatchers(c.Domain, c.File)
+	if err != nil {
+		return nil, err
+	}
+
+	server, ok := d.servers[c.Server]
+	if !ok {
+		return nil, fmt.Errorf("can not find server with tag [%s]", c.Server)
+	}
+	return &forwardRule{matcher: mg, tag: c.Server, server: server}, nil
+}
+
+// matchForward returns the first forward rule that matches q, or nil.
+func (d *Dispatcher) matchForward(q *dns.Msg) *forwardRule {
+	if len(d.forward) == 0 || len(q.Question) != 1 {
+		return nil
+	}
+
+	name := strings.ToLower(q.Question[0].Name)
+	for _, rule := range d.forward {
+		if rule.matcher.Match(name) {
+			return rule
+		}
+	}
+	return nil
+}
@@ -29,6 +29,7 @@ import (
 
 type Handler struct {
 	checkCAME    bool
+	timeout      bool
 	mask4, mask6 uint8
 	rules        []*rule
 }
@@ -39,11 +40,12 @@ type rule struct {
 	domainPolicies *policy.DomainPolicies
 }
 
-func NewIPSetHandler(c *config.Config) (*Handler, error) {
+func NewIPSetHandler(c *config.IPSetConfig) (*Handler, error) {
 	h := new(Handler)
-	h.checkCAME = c.IPSet.CheckCNAME
-	h.mask4 = c.IPSet.Mask4
-	h.mask6 = c.IPSet.Mask6
+	h.checkCAME = c.CheckCNAME
+	h.mask4 = c.Mask4
+	h.mask6 = c.Mask6
+	h.timeout = c.Timeout
 
 	// default
 	if h.mask4 == 0 {
@@ -53,14 +55,14 @@ func NewIPSetHandler(c *config.Config) (*Handler, error) {
 		h.mask6 = 32
 	}
 
-	for _, ipsetConfig := range c.IPSet.Rule {
+	for _, ipsetConfig := range c.Rule {
 		if len(ipsetConfig.SetName4) == 0 && len(ipsetConfig.SetName6) == 0 {
 			continue
 		}
 
-		dps, err := policy.NewDomainPolicies(ipsetConfig.Domain, nil)
+		dps, err := policy.NewDomainPoliciesFromConfig(&ipsetConfig.Domain, nil)
 		if err != nil {
-			return nil, fmt.Errorf("failed to init ipset domain policies %s: %w", ipsetConfig.Domain, err)
+			return nil, fmt.Errorf("failed to init ipset domain policies: %w", err)
 		}
 		rule := &rule{
 			setName4:       ipsetConfig.SetName4,
@@ -116,6 +118,9 @@ func (h *Handler) ApplyIPSet(q, r *dns.Msg) error {
 				if len(entry.SetName) == 0 {
 					continue
 				}
+				if h.timeout {
+					entry.Timeout = r.Answer[i].Header().Ttl
+				}
 
 				logger.GetStd().Debugf("ApplyIPSet: [%v %d]: add %s/%d to set %s", q.Question, q.Id, entry.IP, entry.Mask, entry.SetName)
 				err := AddCIDR(entry)
@@ -26,7 +26,7 @@ import (
 
 type Handler struct{}
 
-func NewIPSetHandler(c *config.Config) (*Handler, error) {
+func NewIPSetHandler(c *config.IPSetConfig) (*Handler, error) {
 	return nil, nil
 }
 
@@ -20,6 +20,7 @@
 package ipset
 
 import (
+	"encoding/binary"
 	"net"
 	"syscall"
 
@@ -30,6 +31,7 @@ import (
 const (
 	IPSET_ATTR_IPADDR_IPV4 = 1
 	IPSET_ATTR_IPADDR_IPV6 = 2
+	IPSET_ATTR_TIMEOUT     = 6
 )
 
 type Entry struct {
@@ -37,6 +39,7 @@ type Entry struct {
 	IP      net.IP
 	Mask    uint8
 	IsNET6  bool
+	Timeout uint32 // in seconds, 0 means the default timeout of the set
 }
 
 func AddCIDR(e *Entry) error {
@@ -72,6 +75,13 @@ func AddCIDR(e *Entry) error {
 	// set mask
 	data.AddRtAttr(nl.IPSET_ATTR_CIDR, nl.Uint8Attr(e.Mask))
 
+	// set timeout
+	if e.Timeout > 0 {
+		timeout := make([]byte, 4)
+		binary.BigEndian.PutUint32(timeout, e.Timeout)
+		data.AddRtAttr(IPSET_ATTR_TIMEOUT|int(nl.NLA_F_NET_BYTEORDER), timeout)
+	}
+
 	req.AddData(data)
 	_, err := req.Execute(unix.NETLINK_NETFILTER, 0)
 
@@ -20,3 +20,15 @@ package domain
 type Matcher interface {
 	Match(fqdn string) bool
 }
+
+// MatcherGroup matches a domain if any of its matchers matches.
+type MatcherGroup []Matcher
+
+func (mg MatcherGroup) Match(fqdn string) bool {
+	for _, m := range mg {
+		if m.Match(fqdn) {
+			return true
+		}
+	}
+	return false
+}
@@ -95,7 +95,7 @@ func NewDomainListMatcherFormReader(r io.Reader, continueOnInvalidString bool) (
 			continue
 		}
 
-		fqdn := dns.Fqdn(line)
+		fqdn := dns.Fqdn(strings.ToLower(line)) // names are lowercased before they are matched
 		if _, ok := dns.IsDomainName(fqdn); !ok {
 			if continueOnInvalidString {
 				logger.GetStd().Warnf("NewMatcherFormReader: invalid domain [%s] at line %d", line, lineCounter)
@@ -0,0 +1,104 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package netlist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+)
+
+// DynamicList is a set of ips that can be modified at runtime.
+// It is safe for concurrent use.
+type DynamicList struct {
+	sync.RWMutex
+	ips map[IPv6]net.IP
+}
+
+func NewDynamicList() *DynamicList {
+	return &DynamicList{ips: make(map[IPv6]net.IP)}
+}
+
+// Add adds ip to the list and reports whether it is new.
+func (l *DynamicList) Add(ip net.IP) bool {
+	if ip.To16() == nil {
+		return false
+	}
+	key := Conv(ip.To16())
+
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := l.ips[key]; ok {
+		return false
+	}
+	l.ips[key] = ip
+	return true
+}
+
+func (l *DynamicList) Match(ip net.IP) bool {
+	if ip.To16() == nil {
+		return false
+	}
+	key := Conv(ip.To16())
+
+	l.RLock()
+	defer l.RUnlock()
+	_, ok := l.ips[key]
+	return ok
+}
+
+func (l *DynamicList) Len() int {
+	l.RLock()
+	defer l.RUnlock()
+	return len(l.ips)
+}
+
+// WriteTo writes ips in the list to w, one per line, in a format that
+// NewListFromReader can read.
+func (l *DynamicList) WriteTo(w io.Writer) (int64, error) {
+	l.RLock()
+	lines := make([]string, 0, len(l.ips))
+	for _, ip := range l.ips {
+		lines = append(lines, ip.String())
+	}
+	l.RUnlock()
+	sort.Strings(lines)
+
+	bw := bufio.NewWriter(w)
+	var n int64
+	for _, line := range lines {
+		nn, err := fmt.Fprintln(bw, line)
+		n += int64(nn)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, bw.Flush()
+}
+
+var registered sync.Map
+
+// RegisterMatcher registers m as name. NewIPMatcherFromFile(name) will
+// return m instead of loading the file, so policies can use matchers
+// that are built at runtime.
+func RegisterMatcher(name string, m Matcher) {
+	registered.Store(name, m)
+}
@@ -22,3 +22,15 @@ import "net"
 type Matcher interface {
 	Match(ip net.IP) bool
 }
+
+// MatcherGroup matches an ip if any of its matchers matches.
+type MatcherGroup []Matcher
+
+func (mg MatcherGroup) Match(ip net.IP) bool {
+	for _, m := range mg {
+		if m.Match(ip) {
+			return true
+		}
+	}
+	return false
+}
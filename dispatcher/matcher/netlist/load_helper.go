@@ -74,7 +74,12 @@ func NewListFromReader(reader io.Reader, continueOnInvalidString bool) (*List, e
 
 // NewIPMatcherFromFile loads a netlist file a list or geoip file.
 // if file contains a ':' and has format like 'geoip:cn', file must be a geoip file.
+// Matchers registered by RegisterMatcher are returned directly.
 func NewIPMatcherFromFile(file string) (Matcher, error) {
+	if m, ok := registered.Load(file); ok {
+		return m.(Matcher), nil
+	}
+
 	e, ok := matcherCache.Load(file)
 	if ok {
 		if m, ok := e.(Matcher); ok {
@@ -0,0 +1,168 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/logger"
+	"github.com/miekg/dns"
+	"net"
+	"sync/atomic"
+)
+
+// replyModifier rewrites replies that are accepted by an upstream.
+type replyModifier struct {
+	address  map[string]net.IP // key is net.IP.To16()
+	dropAAAA bool
+	minimal  bool
+	rotate   bool
+	fastest  *fastestIP // can be nil
+
+	rotateCount uint32
+}
+
+// newReplyModifier returns a nil modifier if it is not configured.
+func newReplyModifier(uc *config.UpstreamEntryConfig) (*replyModifier, error) {
+	mc := &uc.Modify
+	if len(mc.Address) == 0 && !mc.DropAAAA && !mc.Minimal && !mc.Rotate && mc.Fastest.Port == 0 {
+		return nil, nil
+	}
+	if mc.Rotate && mc.Fastest.Port != 0 {
+		return nil, errors.New("rotate can't be used with fastest")
+	}
+
+	m := &replyModifier{dropAAAA: mc.DropAAAA, minimal: mc.Minimal, rotate: mc.Rotate, fastest: newFastestIP(uc)}
+	if len(mc.Address) != 0 {
+		m.address = make(map[string]net.IP, len(mc.Address))
+		for from, to := range mc.Address {
+			fromIP, toIP := net.ParseIP(from), net.ParseIP(to)
+			if fromIP == nil || toIP == nil {
+				return nil, fmt.Errorf("invalid address override [%s: %s]", from, to)
+			}
+			if (fromIP.To4() == nil) != (toIP.To4() == nil) {
+				return nil, fmt.Errorf("address override [%s: %s] has different families", from, to)
+			}
+			if v4 := toIP.To4(); v4 != nil { // ipset adds A records as 4-byte addresses
+				toIP = v4
+			}
+			m.address[string(fromIP.To16())] = toIP
+		}
+	}
+	return m, nil
+}
+
+// modifyReply applies the entry's modifier to r.
+func (u *upstreamEntry) modifyReply(ctx context.Context, q, r *dns.Msg) {
+	m := u.modifier
+	if m.dropAAAA && u.hasA(ctx, q, r) {
+		logger.GetStd().Debugf("upstream %s: [%v %d]: domain has A records, AAAA answers are dropped", u.name, q.Question, q.Id)
+		answer := r.Answer[:0]
+		for _, rr := range r.Answer {
+			if _, ok := rr.(*dns.AAAA); !ok {
+				answer = append(answer, rr)
+			}
+		}
+		r.Answer = answer
+	}
+
+	if len(m.address) != 0 {
+		for _, rr := range r.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				if to, ok := m.address[string(rr.A.To16())]; ok {
+					rr.A = to
+				}
+			case *dns.AAAA:
+				if to, ok := m.address[string(rr.AAAA.To16())]; ok {
+					rr.AAAA = to
+				}
+			}
+		}
+	}
+
+	if m.minimal {
+		r.Ns = nil
+		extra := r.Extra[:0]
+		for _, rr := range r.Extra {
+			if rr.Header().Rrtype == dns.TypeOPT { // keep edns0
+				extra = append(extra, rr)
+			}
+		}
+		r.Extra = extra
+	}
+
+	if m.rotate {
+		rotateIPs(r, int(atomic.AddUint32(&m.rotateCount, 1)))
+	}
+
+	if m.fastest != nil {
+		m.fastest.sort(r)
+	}
+}
+
+// hasA reports whether r has AAAA answers and the domain has A records.
+// If q is an AAAA query, a A query is sent to the backend.
+func (u *upstreamEntry) hasA(ctx context.Context, q, r *dns.Msg) bool {
+	hasAAAA := false
+	for _, rr := range r.Answer {
+		switch rr.(type) {
+		case *dns.A:
+			return true
+		case *dns.AAAA:
+			hasAAAA = true
+		}
+	}
+	if !hasAAAA || len(q.Question) != 1 || q.Question[0].Qtype != dns.TypeAAAA {
+		return false
+	}
+
+	qa := new(dns.Msg)
+	qa.SetQuestion(q.Question[0].Name, dns.TypeA)
+	ra, err := u.queryBackend(ctx, qa)
+	if err != nil {
+		logger.GetStd().Debugf("upstream %s: [%v %d]: failed to query A records: %v", u.name, q.Question, q.Id, err)
+		return false
+	}
+	return len(msgIPs(ra, "")) != 0
+}
+
+// rotateIPs rotates A and AAAA answers by n. Other answers, e.g. CNAMEs,
+// keep their positions.
+func rotateIPs(r *dns.Msg, n int) {
+	var idx []int
+	for i, rr := range r.Answer {
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+			idx = append(idx, i)
+		}
+	}
+	if len(idx) < 2 {
+		return
+	}
+
+	rrs := make([]dns.RR, len(idx))
+	for i := range idx {
+		rrs[i] = r.Answer[idx[i]]
+	}
+	for i := range idx {
+		r.Answer[idx[i]] = rrs[(i+n)%len(rrs)]
+	}
+}
@@ -0,0 +1,112 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+// dualStackUpstream answers A and AAAA queries with two records each.
+var dualStackUpstream = funcUpstream(func(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	name := q.Question[0].Name
+	switch q.Question[0].Qtype {
+	case dns.TypeA:
+		for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+			r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP(ip)})
+		}
+	case dns.TypeAAAA:
+		for _, ip := range []string{"::1", "::2"} {
+			r.Answer = append(r.Answer, &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET}, AAAA: net.ParseIP(ip)})
+		}
+	}
+	r.Ns = []dns.RR{&dns.NS{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeNS, Class: dns.ClassINET}, Ns: "ns.example."}}
+	r.SetEdns0(1232, false)
+	return r, nil
+})
+
+func Test_upstreamEntry_modifyReply(t *testing.T) {
+	newEntry := func(t *testing.T, f func(uc *config.UpstreamEntryConfig)) *upstreamEntry {
+		uc := new(config.UpstreamEntryConfig)
+		f(uc)
+		m, err := newReplyModifier(uc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &upstreamEntry{backend: dualStackUpstream, modifier: m}
+	}
+	exchange := func(t *testing.T, u *upstreamEntry, qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", qtype)
+		r, err := u.Exchange(context.Background(), q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	t.Run("address", func(t *testing.T) {
+		u := newEntry(t, func(uc *config.UpstreamEntryConfig) { uc.Modify.Address = map[string]string{"2.2.2.2": "3.3.3.3"} })
+		r := exchange(t, u, dns.TypeA)
+		ips := msgIPs(r, "")
+		if !ips[1].Equal(net.ParseIP("3.3.3.3")) {
+			t.Fatalf("address is not replaced, got %v", ips)
+		}
+		if len(ips[1]) != net.IPv4len {
+			t.Fatalf("replaced A record should have a 4-byte address, got %d bytes", len(ips[1]))
+		}
+	})
+
+	t.Run("drop aaaa", func(t *testing.T) {
+		u := newEntry(t, func(uc *config.UpstreamEntryConfig) { uc.Modify.DropAAAA = true })
+		if r := exchange(t, u, dns.TypeAAAA); len(r.Answer) != 0 {
+			t.Fatalf("AAAA answers are not dropped, got %v", r.Answer)
+		}
+		if r := exchange(t, u, dns.TypeA); len(r.Answer) != 2 {
+			t.Fatalf("A answers should be kept, got %v", r.Answer)
+		}
+	})
+
+	t.Run("minimal", func(t *testing.T) {
+		u := newEntry(t, func(uc *config.UpstreamEntryConfig) { uc.Modify.Minimal = true })
+		r := exchange(t, u, dns.TypeA)
+		if len(r.Ns) != 0 || r.IsEdns0() == nil {
+			t.Fatalf("want no authority section and an edns0 record, got %v", r)
+		}
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		u := newEntry(t, func(uc *config.UpstreamEntryConfig) { uc.Modify.Rotate = true })
+		first := msgIPs(exchange(t, u, dns.TypeA), "")[0]
+		second := msgIPs(exchange(t, u, dns.TypeA), "")[0]
+		if first.Equal(second) {
+			t.Fatalf("answers are not rotated, both start with %s", first)
+		}
+	})
+
+	uc := new(config.UpstreamEntryConfig)
+	uc.Modify.Address = map[string]string{"1.1.1.1": "::1"}
+	if _, err := newReplyModifier(uc); err == nil {
+		t.Fatal("address override with different families should be rejected")
+	}
+}
@@ -0,0 +1,470 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/logger"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/matcher/domain"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/matcher/netlist"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/policy"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/server"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/upstream"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// pipelineState is the state of a query in a pipeline.
+type pipelineState struct {
+	q    *dns.Msg
+	meta *server.RequestMeta
+	r    *dns.Msg // current reply, nil if the query is not sent yet
+}
+
+// step is a step of a pipeline. If done is true, the pipeline ends
+// and (r, err) is the result of the upstream.
+type step interface {
+	exec(ctx context.Context, u *upstreamEntry, s *pipelineState) (done bool, r *dns.Msg, err error)
+}
+
+type stepFunc func(ctx context.Context, u *upstreamEntry, s *pipelineState) (done bool, r *dns.Msg, err error)
+
+func (f stepFunc) exec(ctx context.Context, u *upstreamEntry, s *pipelineState) (done bool, r *dns.Msg, err error) {
+	return f(ctx, u, s)
+}
+
+// sequence executes steps in order.
+type sequence []step
+
+func (seq sequence) exec(ctx context.Context, u *upstreamEntry, s *pipelineState) (done bool, r *dns.Msg, err error) {
+	for _, st := range seq {
+		if done, r, err = st.exec(ctx, u, s); done {
+			return done, r, err
+		}
+	}
+	return false, nil, nil
+}
+
+var builtinSteps = map[string]stepFunc{
+	"client":            stepClient,
+	"qtype":             stepQtype,
+	"unhandlable_types": stepUnhandlableTypes,
+	"domain":            stepDomain,
+	"query":             stepQuery,
+	"error_rcode":       stepErrorRcode,
+	"bogus_ip":          stepBogusIP,
+	"cname":             stepCNAME,
+	"without_ip":        stepWithoutIP,
+	"ip":                stepIP,
+}
+
+var defaultPipeline = sequence{
+	stepFunc(stepClient),
+	stepFunc(stepQtype),
+	stepFunc(stepUnhandlableTypes),
+	stepFunc(stepDomain),
+	stepFunc(stepQuery),
+	stepFunc(stepErrorRcode),
+	stepFunc(stepBogusIP),
+	stepFunc(stepCNAME),
+	stepFunc(stepWithoutIP),
+	stepFunc(stepIP),
+}
+
+// actionStep ends the pipeline with the action.
+type actionStep struct {
+	action *policy.Action
+}
+
+func (st *actionStep) exec(ctx context.Context, u *upstreamEntry, s *pipelineState) (bool, *dns.Msg, error) {
+	logger.GetStd().Debugf("upstream %s: [%v %d]: pipeline action [%s]", u.name, s.q.Question, s.q.Id, st.action.Mode)
+	return u.finish(ctx, s, st.action)
+}
+
+// forwardStep sends the query to a server.
+type forwardStep struct {
+	tag    string
+	server upstream.Upstream
+}
+
+func (st *forwardStep) exec(ctx context.Context, u *upstreamEntry, s *pipelineState) (bool, *dns.Msg, error) {
+	r, err := st.server.Exchange(ctx, s.q)
+	if err != nil {
+		return true, nil, fmt.Errorf("forward server %s: %w", st.tag, err)
+	}
+	s.r = r
+	return false, nil, nil
+}
+
+// gotoStep ends the pipeline with a named sequence.
+type gotoStep struct {
+	name string
+	seq  *sequence // may not be built yet when this step is built
+}
+
+func (st *gotoStep) exec(ctx context.Context, u *upstreamEntry, s *pipelineState) (bool, *dns.Msg, error) {
+	if done, r, err := st.seq.exec(ctx, u, s); done {
+		return done, r, err
+	}
+	return true, s.r, nil
+}
+
+type ifStep struct {
+	cond      *condition
+	then, els sequence
+}
+
+func (st *ifStep) exec(ctx context.Context, u *upstreamEntry, s *pipelineState) (bool, *dns.Msg, error) {
+	if st.cond.match(s) {
+		return st.then.exec(ctx, u, s)
+	}
+	return st.els.exec(ctx, u, s)
+}
+
+// condition matches if all of its non-nil fields match.
+type condition struct {
+	qtypes map[uint16]struct{}
+	domain domain.Matcher
+	client netlist.Matcher
+
+	rcodes map[int]struct{}
+	hasIP  *bool
+	ip     netlist.Matcher
+}
+
+func (c *condition) match(s *pipelineState) bool {
+	q := s.q
+	if c.qtypes != nil || c.domain != nil {
+		if len(q.Question) != 1 {
+			return false
+		}
+		if _, ok := c.qtypes[q.Question[0].Qtype]; c.qtypes != nil && !ok {
+			return false
+		}
+		if c.domain != nil && !c.domain.Match(strings.ToLower(q.Question[0].Name)) {
+			return false
+		}
+	}
+	if c.client != nil {
+		if clientIP := s.meta.ClientIP(); clientIP == nil || !c.client.Match(clientIP) {
+			return false
+		}
+	}
+
+	if c.rcodes == nil && c.hasIP == nil && c.ip == nil {
+		return true
+	}
+	if s.r == nil {
+		return false
+	}
+	if _, ok := c.rcodes[s.r.Rcode]; c.rcodes != nil && !ok {
+		return false
+	}
+	if c.hasIP != nil && checkMsgHasValidIP(s.r) != *c.hasIP {
+		return false
+	}
+	if c.ip != nil {
+		matched := false
+		for _, ip := range msgIPs(s.r, "") {
+			if c.ip.Match(ip) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func newCondition(c *config.PipelineCondition) (*condition, error) {
+	cond := new(condition)
+	if len(c.QType) != 0 {
+		cond.qtypes = make(map[uint16]struct{})
+		for _, s := range c.QType {
+			typ, err := policy.ParseQtype(strings.ToUpper(s))
+			if err != nil {
+				return nil, err
+			}
+			cond.qtypes[uint16(typ)] = struct{}{}
+		}
+	}
+	if len(c.Rcode) != 0 {
+		cond.rcodes = make(map[int]struct{})
+		for _, s := range c.Rcode {
+			rcode, err := policy.ParseRcode(strings.ToUpper(s))
+			if err != nil {
+				return nil, err
+			}
+			cond.rcodes[rcode] = struct{}{}
+		}
+	}
+	cond.hasIP = c.HasIP
+
+	var err error
+	if c.Domain != nil {
+		if cond.domain, err = policy.NewDomainMatcherFromRule(c.Domain); err != nil {
+			return nil, fmt.Errorf("domain: %w", err)
+		}
+	}
+	if c.Client != nil {
+		if cond.client, err = policy.NewIPMatcherFromRule(c.Client); err != nil {
+			return nil, fmt.Errorf("client: %w", err)
+		}
+	}
+	if c.IP != nil {
+		if cond.ip, err = policy.NewIPMatcherFromRule(c.IP); err != nil {
+			return nil, fmt.Errorf("ip: %w", err)
+		}
+	}
+	return cond, nil
+}
+
+// newSequence builds steps. building is the names of the sequences that
+// are being built, it is used to detect goto loops.
+func (d *Dispatcher) newSequence(steps []*config.PipelineStep, building map[string]bool) (sequence, error) {
+	seq := make(sequence, 0, len(steps))
+	for i, sc := range steps {
+		st, err := d.newStep(sc, building)
+		if err != nil {
+			return nil, fmt.Errorf("step #%d: %w", i, err)
+		}
+		seq = append(seq, st)
+	}
+	return seq, nil
+}
+
+func (d *Dispatcher) newStep(c *config.PipelineStep, building map[string]bool) (step, error) {
+	n := 0
+	for _, set := range []bool{len(c.Step) != 0, len(c.Action) != 0, len(c.Forward) != 0, len(c.Goto) != 0, c.If != nil} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return nil, errors.New("a step should have one of step, action, forward, goto and if")
+	}
+	if c.If == nil && (len(c.Then) != 0 || len(c.Else) != 0) {
+		return nil, errors.New("then and else need an if")
+	}
+
+	switch {
+	case len(c.Step) != 0:
+		f, ok := builtinSteps[c.Step]
+		if !ok {
+			return nil, fmt.Errorf("unknown step [%s]", c.Step)
+		}
+		return f, nil
+
+	case len(c.Action) != 0:
+		action, err := policy.NewAction(c.Action, d.servers)
+		if err != nil {
+			return nil, err
+		}
+		return &actionStep{action: action}, nil
+
+	case len(c.Forward) != 0:
+		server, ok := d.servers[c.Forward]
+		if !ok {
+			return nil, fmt.Errorf("can not find server with tag [%s]", c.Forward)
+		}
+		return &forwardStep{tag: c.Forward, server: server}, nil
+
+	case len(c.Goto) != 0:
+		seq, err := d.namedSequence(c.Goto, building)
+		if err != nil {
+			return nil, err
+		}
+		return &gotoStep{name: c.Goto, seq: seq}, nil
+
+	default:
+		cond, err := newCondition(c.If)
+		if err != nil {
+			return nil, fmt.Errorf("invalid if: %w", err)
+		}
+		st := &ifStep{cond: cond}
+		if st.then, err = d.newSequence(c.Then, building); err != nil {
+			return nil, fmt.Errorf("then: %w", err)
+		}
+		if st.els, err = d.newSequence(c.Else, building); err != nil {
+			return nil, fmt.Errorf("else: %w", err)
+		}
+		return st, nil
+	}
+}
+
+// namedSequence returns the named sequence from config.Sequences.
+// Sequences are built once and shared by all upstreams.
+func (d *Dispatcher) namedSequence(name string, building map[string]bool) (*sequence, error) {
+	if seq, ok := d.sequences[name]; ok {
+		return seq, nil
+	}
+	if building[name] {
+		return nil, fmt.Errorf("goto loop at sequence [%s]", name)
+	}
+
+	var steps []*config.PipelineStep
+	var ok bool
+	if d.config != nil {
+		steps, ok = d.config.Sequences[name]
+	}
+	if !ok {
+		return nil, fmt.Errorf("can not find sequence [%s]", name)
+	}
+
+	building[name] = true
+	seq, err := d.newSequence(steps, building)
+	delete(building, name)
+	if err != nil {
+		return nil, fmt.Errorf("sequence %s: %w", name, err)
+	}
+
+	if d.sequences == nil {
+		d.sequences = make(map[string]*sequence)
+	}
+	d.sequences[name] = &seq
+	return &seq, nil
+}
+
+// finish ends the pipeline with the action.
+func (u *upstreamEntry) finish(ctx context.Context, s *pipelineState, action *policy.Action) (bool, *dns.Msg, error) {
+	r, err := u.doAction(ctx, s.q, s.r, action)
+	return true, r, err
+}
+
+func stepClient(ctx context.Context, u *upstreamEntry, s *pipelineState) (bool, *dns.Msg, error) {
+	if clientIP := s.meta.ClientIP(); u.policies.query.client != nil && clientIP != nil {
+		if action := u.policies.query.client.Match(clientIP); action != nil {
+			logger.GetStd().Debugf("upstream %s: [%v %d]: client %s is matched, action [%s]", u.name, s.q.Question, s.q.Id, clientIP, action.Mode)
+			return u.finish(ctx, s, action)
+		}
+	}
+	return false, nil, nil
+}
+
+func stepQtype(ctx context.Context, u *upstreamEntry, s *pipelineState) (bool, *dns.Msg, error) {
+	if u.policies.query.qtype != nil && len(s.q.Question) == 1 {
+		if action := u.policies.query.qtype.Match(s.q.Question[0].Qtype); action != nil {
+			logger.GetStd().Debugf("upstream %s: [%v %d]: query is matched by qtype, action [%s]", u.name, s.q.Question, s.q.Id, action.Mode)
+			return u.finish(ctx, s, action)
+		}
+	}
+	return false, nil, nil
+}
+
+func stepUnhandlableTypes(ctx context.Context, u *upstreamEntry, s *pipelineState) (bool, *dns.Msg, error) {
+	if isUnhandlableType(s.q) {
+		if action := u.policies.query.unhandlableTypes; action != nil {
+			logger.GetStd().Debugf("upstream %s: [%v %d]: query is unhandlable type, action [%s]", u.name, s.q.Question, s.q.Id, action.Mode)
+			return u.finish(ctx, s, action)
+		}
+	}
+	return false, nil, nil
+}
+
+func stepDomain(ctx context.Context, u *upstreamEntry, s *pipelineState) (bool, *dns.Msg, error) {
+	if u.policies.query.Domain != nil && len(s.q.Question) == 1 {
+		if action := u.policies.query.Domain.Match(s.q.Question[0].Name); action != nil {
+			logger.GetStd().Debugf("upstream %s: [%v %d]: query is matched by domain, action [%s]", u.name, s.q.Question, s.q.Id, action.Mode)
+			return u.finish(ctx, s, action)
+		}
+	}
+	return false, nil, nil
+}
+
+// stepQuery sends the query to the backend. Errors are handled by the
+// error policy and end the pipeline.
+func stepQuery(ctx context.Context, u *upstreamEntry, s *pipelineState) (bool, *dns.Msg, error) {
+	r, err := u.queryBackend(ctx, s.q)
+	if err != nil {
+		r, err = u.handleError(ctx, s.q, err)
+		return true, r, err
+	}
+	s.r = r
+	return false, nil, nil
+}
+
+func stepErrorRcode(ctx context.Context, u *upstreamEntry, s *pipelineState) (bool, *dns.Msg, error) {
+	r := s.r
+	if r == nil || r.Rcode == dns.RcodeSuccess {
+		return false, nil, nil
+	}
+
+	if kind := rcodeKind(r.Rcode); len(kind) != 0 {
+		if action := u.policies.error.match(kind); action != nil {
+			logger.GetStd().Debugf("upstream %s: [%v %d]: reply has rcode %s, action [%s]", u.name, s.q.Question, s.q.Id, dns.RcodeToString[r.Rcode], action.Mode)
+			return u.finish(ctx, s, action)
+		}
+	}
+
+	if u.policies.reply.errorRcode != nil {
+		if action := u.policies.reply.errorRcode.Match(r.Rcode); action != nil {
+			logger.GetStd().Debugf("upstream %s: [%v %d]: reply has rcode %s, action [%s]", u.name, s.q.Question, s.q.Id, dns.RcodeToString[r.Rcode], action.Mode)
+			return u.finish(ctx, s, action)
+		}
+	}
+	return false, nil, nil
+}
+
+// stepBogusIP checks whether the reply has a well-known poisoned address.
+func stepBogusIP(ctx context.Context, u *upstreamEntry, s *pipelineState) (bool, *dns.Msg, error) {
+	if s.r == nil || u.policies.reply.bogusIP == nil {
+		return false, nil, nil
+	}
+	for _, ip := range msgIPs(s.r, "") {
+		if action := u.policies.reply.bogusIP.Match(ip); action != nil {
+			logger.GetStd().Warnf("upstream %s: [%v %d]: reply has bogus ip %s, action [%s]", u.name, s.q.Question, s.q.Id, ip, action.Mode)
+			return u.finish(ctx, s, action)
+		}
+	}
+	return false, nil, nil
+}
+
+func stepCNAME(ctx context.Context, u *upstreamEntry, s *pipelineState) (bool, *dns.Msg, error) {
+	if s.r != nil && u.policies.reply.cname != nil {
+		if action := checkMsgCNAME(u.policies.reply.cname, s.r); action != nil {
+			logger.GetStd().Debugf("upstream %s: [%v %d]: reply cname matched, action [%s]", u.name, s.q.Question, s.q.Id, action.Mode)
+			return u.finish(ctx, s, action)
+		}
+	}
+	return false, nil, nil
+}
+
+func stepWithoutIP(ctx context.Context, u *upstreamEntry, s *pipelineState) (bool, *dns.Msg, error) {
+	if s.r != nil && checkMsgHasValidIP(s.r) == false {
+		if action := u.policies.reply.withoutIP; action != nil {
+			logger.GetStd().Debugf("upstream %s: [%v %d]: reply don not has any valid ip, action [%s]", u.name, s.q.Question, s.q.Id, action.Mode)
+			return u.finish(ctx, s, action)
+		}
+	}
+	return false, nil, nil
+}
+
+func stepIP(ctx context.Context, u *upstreamEntry, s *pipelineState) (bool, *dns.Msg, error) {
+	if s.r != nil && u.policies.reply.ip != nil {
+		if action := u.checkMsgIP(s.q, s.r); action != nil {
+			logger.GetStd().Debugf("upstream %s: [%v %d]: reply ip matched, action [%s]", u.name, s.q.Question, s.q.Id, action.Mode)
+			return u.finish(ctx, s, action)
+		}
+	}
+	return false, nil, nil
+}
@@ -0,0 +1,156 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/upstream"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+	"net"
+	"testing"
+)
+
+func Test_upstreamEntry_pipeline(t *testing.T) {
+	localIP := net.ParseIP("1.1.1.1")
+	remoteIP := net.ParseIP("8.8.8.8")
+	servers := map[string]upstream.Upstream{
+		"local":  &fakeUpstream{ip: localIP},
+		"remote": &fakeUpstream{ip: remoteIP},
+	}
+
+	newEntry := func(t *testing.T, data string) (*upstreamEntry, error) {
+		c := new(config.Config)
+		if err := yaml.Unmarshal([]byte(data), c); err != nil {
+			t.Fatal(err)
+		}
+		d := &Dispatcher{config: c, servers: servers}
+		return d.newEntry("test", c.Upstream["test"])
+	}
+
+	tests := []struct {
+		name    string
+		config  string
+		qName   string
+		wantIP  net.IP // nil means no reply
+		wantErr bool
+	}{
+		{"default", `
+upstream:
+  test: {server: local}
+`, "example.com.", localIP, false},
+		{"if then", `
+upstream:
+  test:
+    server: local
+    pipeline:
+      - if: {domain: {domains: [example.com]}}
+        then: [{forward: remote}]
+        else: [{action: deny}]
+`, "a.example.com.", remoteIP, false},
+		{"else", `
+upstream:
+  test:
+    server: local
+    pipeline:
+      - if: {domain: {domains: [example.com]}}
+        then: [{forward: remote}]
+        else: [{action: deny}]
+`, "example.org.", nil, false},
+		{"reply condition", `
+upstream:
+  test:
+    server: local
+    pipeline:
+      - step: query
+      - if: {ip: {cidrs: [1.1.1.0/24]}, rcode: [noerror]}
+        then: [{action: Redirect_remote}]
+`, "example.com.", remoteIP, false},
+		{"goto", `
+sequences:
+  local_then_remote:
+    - forward: local
+    - if: {has_ip: true}
+      then: [{forward: remote}]
+upstream:
+  test:
+    server: local
+    pipeline:
+      - goto: local_then_remote
+      - action: deny
+`, "example.com.", remoteIP, false},
+		{"default pipeline", `
+pipeline:
+  - action: Address_2.2.2.2
+upstream:
+  test: {server: local}
+`, "example.com.", net.ParseIP("2.2.2.2"), false},
+		{"goto loop", `
+sequences:
+  a: [{goto: b}]
+  b: [{goto: a}]
+upstream:
+  test:
+    server: local
+    pipeline: [{goto: a}]
+`, "", nil, true},
+		{"unknown step", `
+upstream:
+  test:
+    server: local
+    pipeline: [{step: not_a_step}]
+`, "", nil, true},
+		{"two kinds", `
+upstream:
+  test:
+    server: local
+    pipeline: [{step: query, action: deny}]
+`, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := newEntry(t, tt.config)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("invalid pipeline should be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			q := new(dns.Msg)
+			q.SetQuestion(tt.qName, dns.TypeA)
+			r, err := u.Exchange(context.Background(), q, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantIP == nil {
+				if r != nil {
+					t.Fatalf("want no reply, got %v", r)
+				}
+				return
+			}
+			if r == nil || len(r.Answer) == 0 || !r.Answer[0].(*dns.A).A.Equal(tt.wantIP) {
+				t.Fatalf("want %s, got %v", tt.wantIP, r)
+			}
+		})
+	}
+}
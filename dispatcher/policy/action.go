@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/upstream"
+	"net"
 	"strings"
 )
 
@@ -30,16 +31,33 @@ const (
 	PolicyActionAcceptStr      string = "accept"
 	PolicyActionDenyStr        string = "deny"
 	PolicyActionRedirectPrefix string = "Redirect"
+	PolicyActionNoDataStr      string = "nodata"
+	PolicyActionNXDomainStr    string = "nxdomain"
+	PolicyActionRefusedStr     string = "refused"
+	PolicyActionBlackholeStr   string = "blackhole"
+	PolicyActionAddressPrefix  string = "Address"
 
 	PolicyActionAccept ActionMode = iota
 	PolicyActionDeny
 	PolicyActionRedirect
+
+	// below actions answer the query with a synthesized reply.
+	PolicyActionNoData
+	PolicyActionNXDomain
+	PolicyActionRefused
+	PolicyActionBlackhole // answers 0.0.0.0 or ::
+	PolicyActionAddress   // answers Action.Addrs
 )
 
 var ActionModeToStr = map[ActionMode]string{
-	PolicyActionAccept:   PolicyActionAcceptStr,
-	PolicyActionDeny:     PolicyActionDenyStr,
-	PolicyActionRedirect: PolicyActionRedirectPrefix,
+	PolicyActionAccept:    PolicyActionAcceptStr,
+	PolicyActionDeny:      PolicyActionDenyStr,
+	PolicyActionRedirect:  PolicyActionRedirectPrefix,
+	PolicyActionNoData:    PolicyActionNoDataStr,
+	PolicyActionNXDomain:  PolicyActionNXDomainStr,
+	PolicyActionRefused:   PolicyActionRefusedStr,
+	PolicyActionBlackhole: PolicyActionBlackholeStr,
+	PolicyActionAddress:   PolicyActionAddressPrefix,
 }
 
 func (m ActionMode) String() string {
@@ -50,29 +68,60 @@ func (m ActionMode) String() string {
 	return fmt.Sprintf("unknown action Mode %d", m)
 }
 
+// IsSynthesized reports whether the action answers the query with a synthesized reply.
+func (m ActionMode) IsSynthesized() bool {
+	switch m {
+	case PolicyActionNoData, PolicyActionNXDomain, PolicyActionRefused, PolicyActionBlackhole, PolicyActionAddress:
+		return true
+	default:
+		return false
+	}
+}
+
 type Action struct {
 	Mode     ActionMode
 	Redirect upstream.Upstream
+	Addrs    []net.IP
 }
 
-// NewAction accepts PolicyActionAcceptStr, PolicyActionDenyStr
-// and string with prefix policyActionRedirectStr.
+// NewAction accepts PolicyActionAcceptStr, PolicyActionDenyStr,
+// PolicyActionNoDataStr, PolicyActionNXDomainStr, PolicyActionRefusedStr,
+// PolicyActionBlackholeStr, string with prefix policyActionRedirectStr
+// and string with prefix PolicyActionAddressPrefix, e.g. "Address_1.2.3.4,[::1]".
 func NewAction(s string, servers map[string]upstream.Upstream) (*Action, error) {
 	var mode ActionMode
 	var redirect upstream.Upstream
+	var addrs []net.IP
 	var ok bool
 	switch {
 	case s == PolicyActionAcceptStr:
 		mode = PolicyActionAccept
 	case s == PolicyActionDenyStr:
 		mode = PolicyActionDeny
+	case s == PolicyActionNoDataStr:
+		mode = PolicyActionNoData
+	case s == PolicyActionNXDomainStr:
+		mode = PolicyActionNXDomain
+	case s == PolicyActionRefusedStr:
+		mode = PolicyActionRefused
+	case s == PolicyActionBlackholeStr:
+		mode = PolicyActionBlackhole
+	case strings.HasPrefix(s, PolicyActionAddressPrefix+"_"):
+		mode = PolicyActionAddress
+		for _, addr := range strings.Split(strings.TrimPrefix(s, PolicyActionAddressPrefix+"_"), ",") {
+			ip := net.ParseIP(strings.Trim(addr, "[]"))
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address [%s]", addr)
+			}
+			addrs = append(addrs, ip)
+		}
 	case strings.HasPrefix(s, PolicyActionRedirectPrefix):
 		if servers == nil {
 			return nil, errors.New("redirect is not allowed")
 		}
 
 		mode = PolicyActionRedirect
-		serverTag := strings.TrimLeft(s, PolicyActionRedirectPrefix+"_")
+		serverTag := strings.TrimPrefix(s, PolicyActionRedirectPrefix+"_")
 		redirect, ok = servers[serverTag]
 		if !ok {
 			return nil, fmt.Errorf("unable to Redirect, can not find server with tag [%s]", serverTag)
@@ -81,5 +130,24 @@ func NewAction(s string, servers map[string]upstream.Upstream) (*Action, error)
 		return nil, fmt.Errorf("invalid action [%s]", s)
 	}
 
-	return &Action{Mode: mode, Redirect: redirect}, nil
+	return &Action{Mode: mode, Redirect: redirect, Addrs: addrs}, nil
+}
+
+// splitPolicy splits a policy like "action:args" at the first ':' that is
+// not in brackets, so actions can have ipv6 addresses like "Address_[::1]".
+func splitPolicy(s string) []string {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 {
+				return []string{s[:i], s[i+1:]}
+			}
+		}
+	}
+	return []string{s}
 }
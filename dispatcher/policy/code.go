@@ -0,0 +1,142 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package policy
+
+import (
+	"fmt"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/upstream"
+	"github.com/miekg/dns"
+	"strconv"
+	"strings"
+)
+
+// codePolicies matches codes like qtypes and rcodes.
+type codePolicies struct {
+	policies []*codePolicy
+}
+
+type codePolicy struct {
+	codes  map[int]struct{} // nil means match-all
+	action *Action
+}
+
+// newCodePolicies parses s like "action:code1,code2|action". kind is used in errors.
+func newCodePolicies(s, kind string, parse func(s string) (int, error), servers map[string]upstream.Upstream) (*codePolicies, error) {
+	cps := new(codePolicies)
+
+	ss := strings.Split(s, "|")
+	for i := range ss {
+		cp := new(codePolicy)
+
+		tmp := splitPolicy(ss[i])
+
+		actionStr := tmp[0]
+		action, err := NewAction(actionStr, servers)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s policy at index %d: %w", kind, i, err)
+		}
+		cp.action = action
+
+		if len(tmp) == 2 && len(tmp[1]) != 0 {
+			cp.codes = make(map[int]struct{})
+			for _, codeStr := range strings.Split(tmp[1], ",") {
+				code, err := parse(strings.ToUpper(strings.TrimSpace(codeStr)))
+				if err != nil {
+					return nil, fmt.Errorf("invalid %s policy at index %d: %w", kind, i, err)
+				}
+				cp.codes[code] = struct{}{}
+			}
+		}
+
+		cps.policies = append(cps.policies, cp)
+	}
+
+	return cps, nil
+}
+
+func (ps *codePolicies) match(code int) *Action {
+	for i := range ps.policies {
+		if ps.policies[i].codes == nil { // a policy without codes is a default policy
+			return ps.policies[i].action
+		}
+
+		if _, ok := ps.policies[i].codes[code]; ok {
+			return ps.policies[i].action
+		}
+	}
+
+	return nil
+}
+
+type QtypePolicies struct {
+	codePolicies
+}
+
+// NewQtypePolicies parses s like "deny:AAAA,HTTPS|Redirect_local:PTR|accept".
+func NewQtypePolicies(s string, servers map[string]upstream.Upstream) (*QtypePolicies, error) {
+	cps, err := newCodePolicies(s, "qtype", ParseQtype, servers)
+	if err != nil {
+		return nil, err
+	}
+	return &QtypePolicies{codePolicies: *cps}, nil
+}
+
+// ParseQtype parses upper case type names like "AAAA" and "TYPE65".
+func ParseQtype(s string) (int, error) {
+	if typ, ok := dns.StringToType[s]; ok {
+		return int(typ), nil
+	}
+	if strings.HasPrefix(s, "TYPE") {
+		if typ, err := strconv.ParseUint(s[4:], 10, 16); err == nil {
+			return int(typ), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid type [%s]", s)
+}
+
+func (ps *QtypePolicies) Match(qtype uint16) *Action {
+	return ps.match(int(qtype))
+}
+
+type RcodePolicies struct {
+	codePolicies
+}
+
+// NewRcodePolicies parses s like "accept:NXDOMAIN|Redirect_remote:SERVFAIL,REFUSED|deny".
+func NewRcodePolicies(s string, servers map[string]upstream.Upstream) (*RcodePolicies, error) {
+	cps, err := newCodePolicies(s, "rcode", ParseRcode, servers)
+	if err != nil {
+		return nil, err
+	}
+	return &RcodePolicies{codePolicies: *cps}, nil
+}
+
+// ParseRcode parses upper case rcode names like "NXDOMAIN" and numbers.
+func ParseRcode(s string) (int, error) {
+	if rcode, ok := dns.StringToRcode[s]; ok {
+		return rcode, nil
+	}
+	if rcode, err := strconv.ParseUint(s, 10, 12); err == nil {
+		return int(rcode), nil
+	}
+	return 0, fmt.Errorf("invalid rcode [%s]", s)
+}
+
+func (ps *RcodePolicies) Match(rcode int) *Action {
+	return ps.match(rcode)
+}
@@ -52,7 +52,7 @@ func NewIPPolicies(s string, servers map[string]upstream.Upstream) (*IPPolicies,
 	for i := range ss {
 		ipp := new(ipPolicy)
 
-		tmp := strings.SplitN(ss[i], ":", 2)
+		tmp := splitPolicy(ss[i])
 
 		actionStr := tmp[0]
 		action, err := NewAction(actionStr, servers)
@@ -79,17 +79,99 @@ func NewIPPolicies(s string, servers map[string]upstream.Upstream) (*IPPolicies,
 }
 
 func (ps *IPPolicies) Match(ip net.IP) *Action {
-	for i := range ps.policies {
-		if ps.policies[i].matcher == nil { // nil matcher means match-all
-			return ps.policies[i].action
+	if i := ps.matchIndex(ip); i >= 0 {
+		return ps.policies[i].action
+	}
+	return nil
+}
+
+// IPMatchMode decides how IPPolicies.MatchIPs matches multiple ips.
+type IPMatchMode uint8
+
+const (
+	// IPMatchFirst returns the action of the first ip.
+	IPMatchFirst IPMatchMode = iota
+	// IPMatchAny returns the action of the first policy that matches any ip.
+	IPMatchAny
+	// IPMatchAll returns the action of the first policy that matches all ips.
+	IPMatchAll
+	// IPMatchMajority returns the action that most ips have.
+	IPMatchMajority
+)
+
+var strToIPMatchMode = map[string]IPMatchMode{
+	"":         IPMatchFirst,
+	"first":    IPMatchFirst,
+	"any":      IPMatchAny,
+	"all":      IPMatchAll,
+	"majority": IPMatchMajority,
+}
+
+func ParseIPMatchMode(s string) (IPMatchMode, error) {
+	m, ok := strToIPMatchMode[s]
+	if !ok {
+		return 0, fmt.Errorf("invalid ip match mode [%s]", s)
+	}
+	return m, nil
+}
+
+// MatchIPs matches ips according to the mode. It returns nil if ips is
+// empty or no policy is matched.
+func (ps *IPPolicies) MatchIPs(ips []net.IP, mode IPMatchMode) *Action {
+	if len(ips) == 0 {
+		return nil
+	}
+
+	switch mode {
+	case IPMatchAny, IPMatchAll:
+		for _, p := range ps.policies {
+			if p.matcher == nil { // nil matcher means match-all
+				return p.action
+			}
+
+			matched := 0
+			for _, ip := range ips {
+				if p.matcher.Match(ip) {
+					matched++
+				}
+			}
+			if (mode == IPMatchAny && matched > 0) || (mode == IPMatchAll && matched == len(ips)) {
+				return p.action
+			}
 		}
+		return nil
 
-		if ps.policies[i].matcher.Match(ip) {
-			return ps.policies[i].action
+	case IPMatchMajority:
+		votes := make([]int, len(ps.policies))
+		for _, ip := range ips {
+			if i := ps.matchIndex(ip); i >= 0 {
+				votes[i]++
+			}
+		}
+		best := -1
+		for i := range votes {
+			if votes[i] > 0 && (best == -1 || votes[i] > votes[best]) { // ties go to the prior policy
+				best = i
+			}
 		}
+		if best == -1 {
+			return nil
+		}
+		return ps.policies[best].action
+
+	default:
+		return ps.Match(ips[0])
 	}
+}
 
-	return nil
+// matchIndex returns the index of the first policy that matches ip, or -1.
+func (ps *IPPolicies) matchIndex(ip net.IP) int {
+	for i := range ps.policies {
+		if ps.policies[i].matcher == nil || ps.policies[i].matcher.Match(ip) { // nil matcher means match-all
+			return i
+		}
+	}
+	return -1
 }
 
 func NewDomainPolicies(s string, servers map[string]upstream.Upstream) (*DomainPolicies, error) {
@@ -100,7 +182,7 @@ func NewDomainPolicies(s string, servers map[string]upstream.Upstream) (*DomainP
 	for i := range ss {
 		dp := new(domainPolicy)
 
-		tmp := strings.SplitN(ss[i], ":", 2)
+		tmp := splitPolicy(ss[i])
 
 		actionStr := tmp[0]
 		action, err := NewAction(actionStr, servers)
@@ -127,7 +209,10 @@ func NewDomainPolicies(s string, servers map[string]upstream.Upstream) (*DomainP
 	return dps, nil
 }
 
+// Match returns the action of the first policy that matches fqdn.
+// fqdn is case-insensitive.
 func (ps *DomainPolicies) Match(fqdn string) *Action {
+	fqdn = strings.ToLower(fqdn)
 	for i := range ps.policies {
 		if ps.policies[i].matcher == nil { // a policy without a matcher is a default policy
 			return ps.policies[i].action // return its action
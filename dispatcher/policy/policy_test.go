@@ -1,8 +1,14 @@
 package policy
 
 import (
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/matcher/netlist"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/upstream"
 	"github.com/miekg/dns"
+	"io/ioutil"
 	"net"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -75,3 +81,180 @@ func Test_domainPolicies(t *testing.T) {
 		}
 	}
 }
+
+func Test_ipPolicies_MatchIPs(t *testing.T) {
+	p, err := NewIPPolicies("accept:../testdata/ip.list|deny", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := net.ParseIP("1.0.0.1")
+	out := net.ParseIP("12.0.0.255")
+
+	tests := []struct {
+		name string
+		ips  []net.IP
+		mode IPMatchMode
+		want ActionMode
+	}{
+		{"first in", []net.IP{in, out}, IPMatchFirst, PolicyActionAccept},
+		{"first out", []net.IP{out, in}, IPMatchFirst, PolicyActionDeny},
+		{"any", []net.IP{out, in}, IPMatchAny, PolicyActionAccept},
+		{"any none", []net.IP{out, out}, IPMatchAny, PolicyActionDeny},
+		{"all", []net.IP{in, in}, IPMatchAll, PolicyActionAccept},
+		{"all mixed", []net.IP{in, out}, IPMatchAll, PolicyActionDeny},
+		{"majority", []net.IP{out, in, in}, IPMatchMajority, PolicyActionAccept},
+		{"majority out", []net.IP{in, out, out}, IPMatchMajority, PolicyActionDeny},
+		{"majority tie", []net.IP{out, in}, IPMatchMajority, PolicyActionAccept},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if action := p.MatchIPs(tt.ips, tt.mode); action == nil || action.Mode != tt.want {
+				t.Fatalf("want %s, got %v", tt.want, action)
+			}
+		})
+	}
+
+	if p.MatchIPs(nil, IPMatchAny) != nil {
+		t.Fatal("empty ips should not match")
+	}
+}
+
+func Test_qtypePolicies(t *testing.T) {
+	p, err := NewQtypePolicies("deny:AAAA,https|nxdomain:TYPE65535|refused:ANY|accept", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		qtype uint16
+		want  ActionMode
+	}{
+		{dns.TypeAAAA, PolicyActionDeny},
+		{dns.TypeHTTPS, PolicyActionDeny},
+		{65535, PolicyActionNXDomain},
+		{dns.TypeANY, PolicyActionRefused},
+		{dns.TypeA, PolicyActionAccept},
+		{dns.TypePTR, PolicyActionAccept},
+	}
+	for _, tt := range tests {
+		if action := p.Match(tt.qtype); action == nil || action.Mode != tt.want {
+			t.Fatalf("type %s: want action %s, got %v", dns.TypeToString[tt.qtype], tt.want, action)
+		}
+	}
+
+	if _, err := NewQtypePolicies("deny:NOTATYPE", nil); err == nil {
+		t.Fatal("invalid type should be rejected")
+	}
+}
+
+func Test_NewAction_address(t *testing.T) {
+	p, err := NewDomainPolicies("Address_1.2.3.4,[2001:db8::1]:../testdata/domain.list|blackhole", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	action := p.Match("a.com.")
+	if action == nil || action.Mode != PolicyActionAddress {
+		t.Fatalf("want address action, got %v", action)
+	}
+	if len(action.Addrs) != 2 || !action.Addrs[0].Equal(net.ParseIP("1.2.3.4")) || !action.Addrs[1].Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("unexpected addrs %v", action.Addrs)
+	}
+	if action := p.Match("zz.com."); action == nil || action.Mode != PolicyActionBlackhole {
+		t.Fatalf("want blackhole action, got %v", action)
+	}
+
+	if _, err := NewDomainPolicies("Address_::1:../testdata/domain.list", nil); err == nil {
+		t.Fatal("ipv6 address without brackets should be rejected")
+	}
+}
+
+func Test_PoliciesFromConfig(t *testing.T) {
+	dp, err := NewDomainPoliciesFromConfig(&config.Policy{Rules: []*config.PolicyRule{
+		{Action: "deny", Domains: []string{"ads.example.com"}},
+		{Action: "accept", Files: []string{"../testdata/domain.list"}, Domains: []string{"example.com"}},
+		{Action: "Redirect_remote"},
+	}}, map[string]upstream.Upstream{"remote": nil})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for domain, want := range map[string]ActionMode{
+		"ads.example.com.": PolicyActionDeny,
+		"www.example.com.": PolicyActionAccept,
+		"a.com.":           PolicyActionAccept,
+		"zz.com.":          PolicyActionRedirect,
+	} {
+		if action := dp.Match(domain); action == nil || action.Mode != want {
+			t.Fatalf("domain %s: want %s, got %v", domain, want, action)
+		}
+	}
+
+	ipp, err := NewIPPoliciesFromConfig(&config.Policy{Rules: []*config.PolicyRule{
+		{Action: "accept", CIDRs: []string{"192.168.0.0/16", "fd00::/8"}, Files: []string{"../testdata/ip.list"}},
+		{Action: "deny"},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]ActionMode{
+		"192.168.1.1": PolicyActionAccept,
+		"fd00::1":     PolicyActionAccept,
+		"1.0.0.1":     PolicyActionAccept,
+		"8.8.8.8":     PolicyActionDeny,
+	} {
+		if action := ipp.Match(net.ParseIP(ip)); action == nil || action.Mode != want {
+			t.Fatalf("ip %s: want %s, got %v", ip, want, action)
+		}
+	}
+
+	_, err = NewIPPoliciesFromConfig(&config.Policy{Rules: []*config.PolicyRule{
+		{Action: "accept", CIDRs: []string{"10.0.0.0/8"}, Line: 3},
+		{Action: "accept", CIDRs: []string{"10.0.0.0/33"}, Line: 5},
+	}}, nil)
+	if err == nil || !strings.Contains(err.Error(), "#1 at line 5") {
+		t.Fatalf("error should point at the failing rule, got %v", err)
+	}
+}
+
+func Test_NewIPMatcherFromRule_registered(t *testing.T) {
+	file := "registered_by_test.list"
+	l := netlist.NewDynamicList()
+	netlist.RegisterMatcher(file, l)
+
+	m, err := NewIPMatcherFromRule(&config.PolicyRule{Action: "deny", Files: []string{file}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("5.6.7.8")
+	if m.Match(ip) {
+		t.Fatal("ip should not match before it is added")
+	}
+	l.Add(ip)
+	if !m.Match(ip) {
+		t.Fatal("rule doesn't see ips added to the registered list")
+	}
+}
+
+func Test_LoadDomainMatchers_case(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "domain.list")
+	if err := ioutil.WriteFile(file, []byte("Ads.Example.NET\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dp, err := NewDomainPoliciesFromConfig(&config.Policy{Rules: []*config.PolicyRule{
+		{Action: "deny", Domains: []string{"Example.COM"}, Files: []string{file}},
+		{Action: "accept"},
+	}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"www.example.com.", "WWW.Example.Com.", "ads.example.net.", "X.ADS.example.NET."} {
+		if action := dp.Match(name); action == nil || action.Mode != PolicyActionDeny {
+			t.Fatalf("%s: want deny, got %v", name, action)
+		}
+	}
+	if action := dp.Match("example.org."); action == nil || action.Mode != PolicyActionAccept {
+		t.Fatalf("example.org.: want accept, got %v", action)
+	}
+}
@@ -0,0 +1,198 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/matcher/domain"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/matcher/netlist"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/upstream"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// NewDomainPoliciesFromConfig loads domain policies from a legacy string or rules.
+func NewDomainPoliciesFromConfig(c *config.Policy, servers map[string]upstream.Upstream) (*DomainPolicies, error) {
+	if len(c.Rules) == 0 {
+		return NewDomainPolicies(c.Legacy, servers)
+	}
+
+	dps := new(DomainPolicies)
+	for i, rule := range c.Rules {
+		dp, err := newDomainPolicy(rule, servers)
+		if err != nil {
+			return nil, fmt.Errorf("policy rule #%d at line %d: %w", i, rule.Line, err)
+		}
+		dps.policies = append(dps.policies, dp)
+	}
+	return dps, nil
+}
+
+func newDomainPolicy(rule *config.PolicyRule, servers map[string]upstream.Upstream) (*domainPolicy, error) {
+	action, err := NewAction(rule.Action, servers)
+	if err != nil {
+		return nil, err
+	}
+	m, err := NewDomainMatcherFromRule(rule)
+	if err != nil {
+		return nil, err
+	}
+	return &domainPolicy{action: action, matcher: m}, nil
+}
+
+// LoadDomainMatchers returns a matcher that matches domain suffixes in
+// domains and domains in files. Domains are lowercased, so names must be
+// lowercased before they are matched.
+func LoadDomainMatchers(domains, files []string) (domain.MatcherGroup, error) {
+	var mg domain.MatcherGroup
+	if len(domains) != 0 {
+		l := domain.NewListMatcher()
+		for _, s := range domains {
+			fqdn := dns.Fqdn(strings.ToLower(s))
+			if _, ok := dns.IsDomainName(fqdn); !ok {
+				return nil, fmt.Errorf("invalid domain [%s]", s)
+			}
+			l.Add(fqdn)
+		}
+		mg = append(mg, l)
+	}
+	for _, file := range files {
+		m, err := domain.NewDomainMatcherFormFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load domain file from %s, %w", file, err)
+		}
+		mg = append(mg, m)
+	}
+	return mg, nil
+}
+
+// NewDomainMatcherFromRule returns a matcher that matches domains in
+// rule's files, domains and geosite. It returns a nil matcher if rule
+// has none of them.
+func NewDomainMatcherFromRule(rule *config.PolicyRule) (domain.Matcher, error) {
+	if len(rule.CIDRs) != 0 || len(rule.GeoIP) != 0 {
+		return nil, errors.New("cidrs and geoip are not allowed in domain rules")
+	}
+
+	mg, err := LoadDomainMatchers(rule.Domains, rule.Files)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range rule.GeoSite {
+		file, tag, err := splitDatTag(s)
+		if err != nil {
+			return nil, err
+		}
+		m, err := domain.NewV2MatcherFromFile(file, tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load geosite %s, %w", s, err)
+		}
+		mg = append(mg, m)
+	}
+
+	if len(mg) == 0 {
+		return nil, nil
+	}
+	return mg, nil
+}
+
+// NewIPPoliciesFromConfig loads ip policies from a legacy string or rules.
+func NewIPPoliciesFromConfig(c *config.Policy, servers map[string]upstream.Upstream) (*IPPolicies, error) {
+	if len(c.Rules) == 0 {
+		return NewIPPolicies(c.Legacy, servers)
+	}
+
+	ipps := new(IPPolicies)
+	for i, rule := range c.Rules {
+		ipp, err := newIPPolicy(rule, servers)
+		if err != nil {
+			return nil, fmt.Errorf("policy rule #%d at line %d: %w", i, rule.Line, err)
+		}
+		ipps.policies = append(ipps.policies, ipp)
+	}
+	return ipps, nil
+}
+
+func newIPPolicy(rule *config.PolicyRule, servers map[string]upstream.Upstream) (*ipPolicy, error) {
+	action, err := NewAction(rule.Action, servers)
+	if err != nil {
+		return nil, err
+	}
+	m, err := NewIPMatcherFromRule(rule)
+	if err != nil {
+		return nil, err
+	}
+	return &ipPolicy{action: action, matcher: m}, nil
+}
+
+// NewIPMatcherFromRule returns a matcher that matches ips in rule's
+// files, cidrs and geoip. It returns a nil matcher if rule has none of them.
+func NewIPMatcherFromRule(rule *config.PolicyRule) (netlist.Matcher, error) {
+	if len(rule.Domains) != 0 || len(rule.GeoSite) != 0 {
+		return nil, errors.New("domains and geosite are not allowed in ip rules")
+	}
+
+	var mg netlist.MatcherGroup
+	for _, file := range rule.Files {
+		m, err := netlist.NewIPMatcherFromFile(file) // also returns registered lists, e.g. the prober's
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ip file from %s, %w", file, err)
+		}
+		mg = append(mg, m)
+	}
+	if len(rule.CIDRs) != 0 {
+		l := netlist.NewNetList()
+		for _, s := range rule.CIDRs {
+			n, err := netlist.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cidr [%s]", s)
+			}
+			l.Append(n)
+		}
+		l.Sort()
+		mg = append(mg, l)
+	}
+	for _, s := range rule.GeoIP {
+		file, tag, err := splitDatTag(s)
+		if err != nil {
+			return nil, err
+		}
+		m, err := netlist.NewNetListFromDAT(file, tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load geoip %s, %w", s, err)
+		}
+		mg = append(mg, m)
+	}
+
+	if len(mg) == 0 {
+		return nil, nil
+	}
+	return mg, nil
+}
+
+// splitDatTag splits s like "./geosite.dat:cn" at the last ':', so windows
+// paths like "C:\geosite.dat:cn" also work.
+func splitDatTag(s string) (file, tag string, err error) {
+	i := strings.LastIndex(s, ":")
+	if i <= 0 || i == len(s)-1 {
+		return "", "", fmt.Errorf("invalid dat file and tag [%s], it should be like \"./geosite.dat:cn\"", s)
+	}
+	return s[:i], s[i+1:], nil
+}
@@ -0,0 +1,218 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/logger"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/matcher/netlist"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultProbeInterval = time.Hour
+	defaultProbeTimeout  = time.Second * 2
+)
+
+// prober learns poisoned ips by sending queries to a sink address that
+// runs no dns server. The learned ips are registered as an ip file, so
+// policies can use them.
+type prober struct {
+	sink     string
+	domains  []string
+	file     string
+	interval time.Duration
+	timeout  time.Duration
+
+	list *netlist.DynamicList
+}
+
+// newProber returns a nil prober if it is not configured.
+func newProber(c *config.Config) (*prober, error) {
+	pc := &c.Prober
+	if len(pc.Sink) == 0 {
+		return nil, nil
+	}
+	if len(pc.Domains) == 0 {
+		return nil, errors.New("prober needs domains")
+	}
+	if len(pc.File) == 0 {
+		return nil, errors.New("prober needs a file")
+	}
+	if _, _, err := net.SplitHostPort(pc.Sink); err != nil {
+		return nil, fmt.Errorf("invalid sink address %s, %w", pc.Sink, err)
+	}
+
+	p := &prober{
+		sink:     pc.Sink,
+		file:     pc.File,
+		interval: defaultProbeInterval,
+		timeout:  defaultProbeTimeout,
+		list:     netlist.NewDynamicList(),
+	}
+	for _, d := range pc.Domains {
+		p.domains = append(p.domains, dns.Fqdn(d))
+	}
+	if pc.Interval > 0 {
+		p.interval = time.Duration(pc.Interval) * time.Second
+	}
+	if pc.Timeout > 0 {
+		p.timeout = time.Duration(pc.Timeout) * time.Millisecond
+	}
+
+	if err := p.load(); err != nil {
+		return nil, fmt.Errorf("failed to load learned ips from %s, %w", p.file, err)
+	}
+	netlist.RegisterMatcher(p.file, p.list)
+	return p, nil
+}
+
+// run probes every interval. It never returns.
+func (p *prober) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.probeAll()
+		<-ticker.C
+	}
+}
+
+// probeAll probes all domains and saves the learned ips if there are
+// new ones. It returns the number of new ips.
+func (p *prober) probeAll() int {
+	learned := 0
+	for _, name := range p.domains {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			ips, err := p.probe(name, qtype)
+			if err != nil { // ips received before the error are still poisoned
+				logger.GetStd().Warnf("prober: failed to probe %s %s: %v", name, dns.TypeToString[qtype], err)
+			}
+			for _, ip := range ips {
+				if p.list.Add(ip) {
+					learned++
+					logger.GetStd().Infof("prober: learned poisoned ip %s from %s", ip, name)
+				}
+			}
+		}
+	}
+
+	if learned > 0 {
+		if err := p.save(); err != nil {
+			logger.GetStd().Warnf("prober: failed to save learned ips to %s: %v", p.file, err)
+		}
+	}
+	return learned
+}
+
+// probe sends a query to the sink and returns addresses in all replies
+// that come back before the timeout.
+func (p *prober) probe(name string, qtype uint16) ([]net.IP, error) {
+	c, err := net.Dial("udp", p.sink)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	q := new(dns.Msg)
+	q.SetQuestion(name, qtype)
+	b, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(p.timeout))
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return ips, nil
+			}
+			// the sink has no dns server, forged replies can arrive before the refusal.
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				return ips, nil
+			}
+			return ips, err
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(buf[:n]); err != nil || r.Id != q.Id {
+			continue
+		}
+		ips = append(ips, msgIPs(r, "")...)
+	}
+}
+
+// load loads ips from the file. A missing file is not an error.
+func (p *prober) load() error {
+	f, err := os.Open(p.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ip := net.ParseIP(line)
+		if ip == nil {
+			return fmt.Errorf("invalid ip %s", line)
+		}
+		p.list.Add(ip)
+	}
+	return s.Err()
+}
+
+// save writes the learned ips to a temp file and replaces the file with it.
+func (p *prober) save() error {
+	f, err := ioutil.TempFile(filepath.Dir(p.file), filepath.Base(p.file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := p.list.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), p.file)
+}
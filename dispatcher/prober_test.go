@@ -0,0 +1,123 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/matcher/netlist"
+	"github.com/miekg/dns"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// startForger starts a udp server that replies every A query with
+// two forged replies, like a poisoned path does.
+func startForger(t *testing.T, ips ...string) string {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, from, err := c.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			q := new(dns.Msg)
+			if err := q.Unpack(buf[:n]); err != nil || q.Question[0].Qtype != dns.TypeA {
+				continue
+			}
+			for _, ip := range ips {
+				r := new(dns.Msg)
+				r.SetReply(q)
+				r.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP(ip)}}
+				b, _ := r.Pack()
+				c.WriteTo(b, from)
+			}
+		}
+	}()
+	return c.LocalAddr().String()
+}
+
+func Test_prober(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "poisoned.list")
+	if err := ioutil.WriteFile(file, []byte("# learned\n1.2.3.4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := new(config.Config)
+	c.Prober.Sink = startForger(t, "1.2.3.4", "5.6.7.8")
+	c.Prober.Domains = []string{"blocked.example"}
+	c.Prober.File = file
+	c.Prober.Timeout = 200
+	p, err := newProber(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := p.probeAll(); n != 1 {
+		t.Fatalf("want 1 new ip, got %d", n)
+	}
+
+	// policies load the learned ips by the file name
+	m, err := netlist.NewIPMatcherFromFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Match(net.ParseIP("5.6.7.8")) || m.Match(net.ParseIP("8.8.8.8")) {
+		t.Fatal("registered matcher doesn't match learned ips")
+	}
+
+	// the learned ips are persisted
+	saved, err := netlist.NewListFromListFile(file, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.Match(net.ParseIP("1.2.3.4")) || !saved.Match(net.ParseIP("5.6.7.8")) {
+		t.Fatal("learned ips are not saved")
+	}
+}
+
+func Test_prober_refused(t *testing.T) {
+	// a sink without a dns server
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := c.LocalAddr().String()
+	c.Close()
+
+	conf := new(config.Config)
+	conf.Prober.Sink = sink
+	conf.Prober.Domains = []string{"blocked.example"}
+	conf.Prober.File = filepath.Join(t.TempDir(), "poisoned.list")
+	conf.Prober.Timeout = 200
+	p, err := newProber(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.probe("blocked.example.", dns.TypeA); err != nil {
+		t.Fatalf("refused probe should not be an error, got %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/logger"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/matcher/domain"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/matcher/netlist"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/policy"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/upstream"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// rebindingNets are addresses that public domains should not have.
+var rebindingNets = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"100.64.0.0/10",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// rebindingFilter strips or rejects private addresses in replies of
+// domains that are not allowed.
+type rebindingFilter struct {
+	reject bool
+	allow  domain.MatcherGroup
+	nets   *netlist.List
+}
+
+// newRebindingFilter returns a nil filter if it is disabled.
+func newRebindingFilter(c *config.Config) (*rebindingFilter, error) {
+	f := new(rebindingFilter)
+	switch c.Rebinding.Mode {
+	case "":
+		return nil, nil
+	case "strip":
+	case "reject":
+		f.reject = true
+	default:
+		return nil, fmt.Errorf("invalid rebinding mode [%s]", c.Rebinding.Mode)
+	}
+
+	allow, err := policy.LoadDomainMatchers(c.Rebinding.Domain, c.Rebinding.File)
+	if err != nil {
+		return nil, err
+	}
+	f.allow = allow
+
+	f.nets = netlist.NewNetList()
+	for _, s := range rebindingNets {
+		n, err := netlist.ParseCIDR(s)
+		if err != nil {
+			panic(fmt.Sprintf("invalid rebinding net %s: %v", s, err))
+		}
+		f.nets.Append(n)
+	}
+	f.nets.Sort()
+	return f, nil
+}
+
+// wrap makes servers check their replies by the filter. f can be nil.
+func (f *rebindingFilter) wrap(servers map[string]upstream.Upstream) {
+	if f == nil {
+		return
+	}
+	for tag, server := range servers {
+		servers[tag] = &rebindingUpstream{Upstream: server, f: f}
+	}
+}
+
+// rebindingUpstream checks replies from the upstream by a rebindingFilter.
+type rebindingUpstream struct {
+	upstream.Upstream
+	f *rebindingFilter
+}
+
+func (u *rebindingUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	r, err := u.Upstream.Exchange(ctx, q)
+	if err != nil || r == nil {
+		return r, err
+	}
+	return u.f.filter(q, r), nil
+}
+
+// filter returns the reply that should be sent to the client.
+func (f *rebindingFilter) filter(q, r *dns.Msg) *dns.Msg {
+	if len(q.Question) != 1 || f.allow.Match(strings.ToLower(q.Question[0].Name)) {
+		return r
+	}
+
+	answer := r.Answer[:0]
+	for _, rr := range r.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		if ip == nil || !f.nets.Match(ip) {
+			answer = append(answer, rr)
+			continue
+		}
+
+		if f.reject {
+			logger.GetStd().Warnf("rebinding: [%v %d]: reply has private address %s, rejected", q.Question, q.Id, ip)
+			refused := new(dns.Msg)
+			refused.SetRcode(q, dns.RcodeRefused)
+			return refused
+		}
+		logger.GetStd().Warnf("rebinding: [%v %d]: reply has private address %s, stripped", q.Question, q.Id, ip)
+	}
+	r.Answer = answer
+	return r
+}
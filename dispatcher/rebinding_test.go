@@ -0,0 +1,139 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/upstream"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v3"
+	"net"
+	"testing"
+)
+
+func Test_rebindingFilter(t *testing.T) {
+	newReply := func(name string, ips ...string) (q, r *dns.Msg) {
+		q = new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		r = new(dns.Msg)
+		r.SetReply(q)
+		for _, s := range ips {
+			ip := net.ParseIP(s)
+			if ip.To4() == nil {
+				r.Answer = append(r.Answer, &dns.AAAA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET}, AAAA: ip})
+				continue
+			}
+			r.Answer = append(r.Answer, &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET}, A: ip})
+		}
+		return q, r
+	}
+
+	tests := []struct {
+		name      string
+		mode      string
+		qName     string
+		ips       []string
+		wantRcode int
+		wantN     int // answers left
+	}{
+		{"public", "strip", "example.com.", []string{"1.1.1.1"}, dns.RcodeSuccess, 1},
+		{"strip", "strip", "example.com.", []string{"1.1.1.1", "192.168.1.1", "100.64.0.1"}, dns.RcodeSuccess, 1},
+		{"reject", "reject", "example.com.", []string{"1.1.1.1", "127.0.0.1"}, dns.RcodeRefused, 0},
+		{"unspecified", "strip", "example.com.", []string{"1.1.1.1", "0.0.0.0", "0.1.2.3", "::", "2001:db8::1"}, dns.RcodeSuccess, 2},
+		{"allowed", "reject", "router.lan.", []string{"192.168.1.1"}, dns.RcodeSuccess, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := new(config.Config)
+			c.Rebinding.Mode = tt.mode
+			c.Rebinding.Domain = []string{"lan"}
+			f, err := newRebindingFilter(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			q, r := newReply(tt.qName, tt.ips...)
+			r = f.filter(q, r)
+			if r.Rcode != tt.wantRcode || len(r.Answer) != tt.wantN {
+				t.Fatalf("want rcode %d with %d answers, got %v", tt.wantRcode, tt.wantN, r)
+			}
+		})
+	}
+
+	c := new(config.Config)
+	c.Rebinding.Mode = "drop"
+	if _, err := newRebindingFilter(c); err == nil {
+		t.Fatal("invalid mode should be rejected")
+	}
+}
+
+// Blackhole replies are synthesized, they are not rejected even if
+// 0.0.0.0 is a rebinding address.
+func Test_rebindingFilter_synthesized(t *testing.T) {
+	c := new(config.Config)
+	if err := yaml.Unmarshal([]byte(`
+rebinding: {mode: reject}
+upstream:
+  test:
+    server: local
+    policies:
+      query:
+        domain:
+          - {action: blackhole, domains: [ads.example]}
+          - {action: accept}
+`), c); err != nil {
+		t.Fatal(err)
+	}
+	f, err := newRebindingFilter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := map[string]upstream.Upstream{"local": &fakeUpstream{ip: net.ParseIP("127.0.0.1")}}
+	f.wrap(servers)
+
+	d := &Dispatcher{config: c, servers: servers, synth: newSynthesizer(c)}
+	entry, err := d.newEntry("test", c.Upstream["test"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.entriesSlice = []*upstreamEntry{entry}
+
+	tests := []struct {
+		qName     string
+		wantRcode int
+		wantIP    net.IP // nil means no answer
+	}{
+		{"ads.example.", dns.RcodeSuccess, net.IPv4zero},
+		{"evil.example.", dns.RcodeRefused, nil},
+	}
+	for _, tt := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(tt.qName, dns.TypeA)
+		r, err := d.ServeDNS(context.Background(), q, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Rcode != tt.wantRcode {
+			t.Fatalf("%s: want rcode %d, got %v", tt.qName, tt.wantRcode, r)
+		}
+		if ips := msgIPs(r, ""); (tt.wantIP == nil) != (len(ips) == 0) || (tt.wantIP != nil && !ips[0].Equal(tt.wantIP)) {
+			t.Fatalf("%s: want ip %v, got %v", tt.qName, tt.wantIP, ips)
+		}
+	}
+}
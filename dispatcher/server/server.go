@@ -29,7 +29,32 @@ type Server interface {
 }
 
 type Handler interface {
-	ServeDNS(ctx context.Context, q *dns.Msg) (r *dns.Msg, err error)
+	ServeDNS(ctx context.Context, q *dns.Msg, meta *RequestMeta) (r *dns.Msg, err error)
+}
+
+// RequestMeta describes where a query comes from.
+type RequestMeta struct {
+	ClientAddr net.Addr
+	Listener   net.Addr
+	Transport  string // "udp", "tcp" etc.
+}
+
+// ClientIP returns the ip of ClientAddr. It returns nil if ClientAddr
+// doesn't have an ip.
+func (m *RequestMeta) ClientIP() net.IP {
+	if m == nil {
+		return nil
+	}
+	switch addr := m.ClientAddr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.IPAddr:
+		return addr.IP
+	default:
+		return nil
+	}
 }
 
 const (
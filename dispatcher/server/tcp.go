@@ -70,6 +70,12 @@ func (s *tcpServer) ListenAndServe(h Handler) error {
 			tcpConnCtx, cancel := context.WithCancel(listenerCtx)
 			defer cancel()
 
+			meta := &RequestMeta{
+				ClientAddr: c.RemoteAddr(),
+				Listener:   s.l.Addr(),
+				Transport:  "tcp",
+			}
+
 			for {
 				c.SetReadDeadline(time.Now().Add(serverTCPReadTimeout))
 				q, _, err := utils.ReadMsgFromTCP(c)
@@ -83,7 +89,7 @@ func (s *tcpServer) ListenAndServe(h Handler) error {
 
 					logger.GetStd().Debugf("tcp server %s: [%v %d]: new query from %s,", s.l.Addr(), q.Question, q.Id, c.RemoteAddr())
 
-					r, err := h.ServeDNS(queryCtx, q)
+					r, err := h.ServeDNS(queryCtx, q, meta)
 					if err != nil {
 						logger.GetStd().Warnf("tcp server %s: [%v %d]: query failed: %v", s.l.Addr(), q.Question, q.Id, err)
 					}
@@ -80,7 +80,12 @@ func (s *udpServer) ListenAndServe(h Handler) error {
 
 			logger.GetStd().Debugf("udp server %s: [%v %d]: new query from %s", s.socket.LocalAddr(), q.Question, q.Id, from)
 
-			r, err := h.ServeDNS(queryCtx, q)
+			meta := &RequestMeta{
+				ClientAddr: from,
+				Listener:   s.socket.LocalAddr(),
+				Transport:  "udp",
+			}
+			r, err := h.ServeDNS(queryCtx, q, meta)
 			if err != nil {
 				logger.GetStd().Warnf("udp server %s: [%v %d]: query failed: %v", s.socket.LocalAddr(), q.Question, q.Id, err)
 			}
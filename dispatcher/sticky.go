@@ -0,0 +1,101 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/logger"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/server"
+	"github.com/miekg/dns"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stickyMemory remembers which entry answered the last A/AAAA query of
+// a domain, so queries that can't be judged by ip policies can be sent
+// to the same entry.
+type stickyMemory struct {
+	ttl time.Duration
+
+	sync.Mutex
+	m         map[stickyKey]*stickyEntry
+	lastSweep time.Time
+}
+
+type stickyKey struct {
+	p    *profile
+	name string // lower case fqdn
+}
+
+type stickyEntry struct {
+	idx    int // index of profile.entriesSlice
+	expire time.Time
+}
+
+func newStickyMemory(ttl time.Duration) *stickyMemory {
+	return &stickyMemory{ttl: ttl, m: make(map[stickyKey]*stickyEntry)}
+}
+
+func (s *stickyMemory) remember(p *profile, name string, idx int) {
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	s.m[stickyKey{p: p, name: strings.ToLower(name)}] = &stickyEntry{idx: idx, expire: now.Add(s.ttl)}
+
+	if now.Sub(s.lastSweep) > s.ttl {
+		s.lastSweep = now
+		for k, e := range s.m {
+			if now.After(e.expire) {
+				delete(s.m, k)
+			}
+		}
+	}
+}
+
+// lookup returns the entry that is remembered for name or its closest
+// parent domain.
+func (s *stickyMemory) lookup(p *profile, name string) (int, bool) {
+	name = strings.ToLower(name)
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	for _, off := range dns.Split(name) {
+		if e, ok := s.m[stickyKey{p: p, name: name[off:]}]; ok && now.Before(e.expire) {
+			return e.idx, true
+		}
+	}
+	return 0, false
+}
+
+// dispatchSticky sends q to the remembered entry. It returns nil if there
+// is no memory or the entry didn't accept the query.
+func (d *Dispatcher) dispatchSticky(ctx context.Context, p *profile, q *dns.Msg, meta *server.RequestMeta) *dns.Msg {
+	if len(q.Question) != 1 {
+		return nil
+	}
+	idx, ok := d.sticky.lookup(p, q.Question[0].Name)
+	if !ok {
+		return nil
+	}
+
+	logger.GetStd().Debugf("Dispatch: [%v %d] from %s: sticky to upstream %s", q.Question, q.Id, meta.ClientIP(), p.entriesSlice[idx].name)
+	resChan := make(chan *entryResult, 1)
+	d.exchangeEntry(ctx, p, idx, q, meta, resChan)
+	return (<-resChan).r
+}
@@ -0,0 +1,207 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/logger"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/server"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/utils"
+	"github.com/miekg/dns"
+	"time"
+)
+
+type strategy uint8
+
+const (
+	// strategyRace sends the query to all entries and returns the first accepted reply.
+	strategyRace strategy = iota
+	// strategyPriority sends the query to all entries and prefers the reply
+	// from the entry with the highest priority if it arrives within the
+	// grace window after the first accepted reply.
+	strategyPriority
+	// strategySequential sends the query to entries one by one. The next
+	// entry is queried if the previous one failed or didn't reply in hedge.
+	strategySequential
+)
+
+var strToStrategy = map[string]strategy{
+	"":           strategyRace,
+	"race":       strategyRace,
+	"priority":   strategyPriority,
+	"sequential": strategySequential,
+}
+
+func parseStrategy(s string) (strategy, error) {
+	st, ok := strToStrategy[s]
+	if !ok {
+		return 0, fmt.Errorf("invalid dispatch strategy [%s]", s)
+	}
+	return st, nil
+}
+
+// entryResult is the result from p.entriesSlice[idx].
+// r is nil if the entry failed or the reply was denied.
+type entryResult struct {
+	idx int
+	r   *dns.Msg
+}
+
+// exchangeEntry sends q to p.entriesSlice[idx] and sends the result to resChan.
+func (d *Dispatcher) exchangeEntry(ctx context.Context, p *profile, idx int, q *dns.Msg, meta *server.RequestMeta, resChan chan<- *entryResult) {
+	entry := p.entriesSlice[idx]
+
+	queryStart := time.Now()
+	r, err := entry.Exchange(ctx, q, meta)
+	rtt := time.Since(queryStart).Milliseconds()
+	if err != nil {
+		if err != context.Canceled && err != context.DeadlineExceeded {
+			logger.GetStd().Warnf("Dispatch: [%v %d] from %s: upstream %s err after %dms: %v,", q.Question, q.Id, meta.ClientIP(), entry.name, rtt, err)
+		}
+	} else if r != nil {
+		logger.GetStd().Debugf("Dispatch: [%v %d] from %s: reply from upstream %s accepted, rtt: %dms", q.Question, q.Id, meta.ClientIP(), entry.name, rtt)
+	}
+
+	resChan <- &entryResult{idx: idx, r: r} // resChan must be buffered
+}
+
+// dispatchStrategy dispatches q to p's entries by the strategy and returns
+// the accepted result.
+func (d *Dispatcher) dispatchStrategy(ctx context.Context, p *profile, q *dns.Msg, meta *server.RequestMeta) (*entryResult, error) {
+	switch d.strategy {
+	case strategyPriority:
+		return d.dispatchPriority(ctx, p, q, meta)
+	case strategySequential:
+		return d.dispatchSequential(ctx, p, q, meta)
+	default:
+		return d.dispatchRace(ctx, p, q, meta)
+	}
+}
+
+func (d *Dispatcher) dispatchRace(ctx context.Context, p *profile, q *dns.Msg, meta *server.RequestMeta) (*entryResult, error) {
+	resChan := make(chan *entryResult, len(p.entriesSlice))
+	for i := range p.entriesSlice {
+		go d.exchangeEntry(ctx, p, i, q, meta, resChan)
+	}
+
+	for done := 0; done < len(p.entriesSlice); done++ {
+		select {
+		case res := <-resChan:
+			if res.r != nil {
+				return res, nil
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, ErrUpstreamsFailed
+}
+
+func (d *Dispatcher) dispatchPriority(ctx context.Context, p *profile, q *dns.Msg, meta *server.RequestMeta) (*entryResult, error) {
+	resChan := make(chan *entryResult, len(p.entriesSlice))
+	for i := range p.entriesSlice {
+		go d.exchangeEntry(ctx, p, i, q, meta, resChan)
+	}
+
+	results := make([]*entryResult, len(p.entriesSlice))
+	best := -1 // index of the best accepted reply
+	var graceC <-chan time.Time
+	for done := 0; done < len(p.entriesSlice); done++ {
+		select {
+		case res := <-resChan:
+			results[res.idx] = res
+			if res.r == nil {
+				break
+			}
+
+			if best == -1 && d.grace > 0 {
+				graceTimer := utils.GetTimer(d.grace)
+				defer utils.ReleaseTimer(graceTimer)
+				graceC = graceTimer.C
+			}
+			if best == -1 || res.idx < best {
+				best = res.idx
+			}
+		case <-graceC:
+			logger.GetStd().Debugf("Dispatch: [%v %d] from %s: grace window expired, use reply from upstream %s", q.Question, q.Id, meta.ClientIP(), p.entriesSlice[best].name)
+			return results[best], nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		// all entries that have a higher priority are returned
+		if best != -1 && allReturned(results[:best]) {
+			return results[best], nil
+		}
+	}
+
+	return nil, ErrUpstreamsFailed
+}
+
+func allReturned(results []*entryResult) bool {
+	for i := range results {
+		if results[i] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *Dispatcher) dispatchSequential(ctx context.Context, p *profile, q *dns.Msg, meta *server.RequestMeta) (*entryResult, error) {
+	resChan := make(chan *entryResult, len(p.entriesSlice))
+
+	var hedgeTimer *time.Timer
+	var hedgeC <-chan time.Time
+	if d.hedge > 0 {
+		hedgeTimer = utils.GetTimer(d.hedge)
+		defer utils.ReleaseTimer(hedgeTimer)
+		hedgeC = hedgeTimer.C
+	}
+
+	started := 0
+	startNext := func() {
+		if started < len(p.entriesSlice) {
+			go d.exchangeEntry(ctx, p, started, q, meta, resChan)
+			started++
+			if hedgeTimer != nil {
+				utils.ResetAndDrainTimer(hedgeTimer, d.hedge)
+			}
+		}
+	}
+	startNext()
+
+	for done := 0; done < len(p.entriesSlice); {
+		select {
+		case res := <-resChan:
+			done++
+			if res.r != nil {
+				return res, nil
+			}
+			if done == started { // nothing is running, try next one now
+				startNext()
+			}
+		case <-hedgeC:
+			logger.GetStd().Debugf("Dispatch: [%v %d] from %s: upstream %s did not reply in time, try next one", q.Question, q.Id, meta.ClientIP(), p.entriesSlice[started-1].name)
+			startNext()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	return nil, ErrUpstreamsFailed
+}
@@ -0,0 +1,144 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/policy"
+	"github.com/miekg/dns"
+	"net"
+)
+
+const (
+	defaultSynthesizedTTL = 300
+	defaultSOAMName       = "ns.mos-chinadns."
+	defaultSOARName       = "hostmaster.mos-chinadns."
+)
+
+// synthesizer generates replies for synthesized actions.
+// A nil synthesizer uses default values.
+type synthesizer struct {
+	ttl          uint32
+	mName, rName string
+}
+
+func newSynthesizer(c *config.Config) *synthesizer {
+	s := &synthesizer{
+		ttl:   c.Synthesize.TTL,
+		mName: dns.Fqdn(c.Synthesize.SOA.MName),
+		rName: dns.Fqdn(c.Synthesize.SOA.RName),
+	}
+	if s.ttl == 0 {
+		s.ttl = defaultSynthesizedTTL
+	}
+	if len(c.Synthesize.SOA.MName) == 0 {
+		s.mName = defaultSOAMName
+	}
+	if len(c.Synthesize.SOA.RName) == 0 {
+		s.rName = defaultSOARName
+	}
+	return s
+}
+
+var (
+	blackholeAddrs     = []net.IP{net.IPv4zero, net.IPv6zero}
+	defaultSynthesizer = &synthesizer{ttl: defaultSynthesizedTTL, mName: defaultSOAMName, rName: defaultSOARName}
+)
+
+// reply returns a reply to q for the synthesized action.
+func (s *synthesizer) reply(q *dns.Msg, action *policy.Action) *dns.Msg {
+	if s == nil {
+		s = defaultSynthesizer
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.RecursionAvailable = true
+
+	switch action.Mode {
+	case policy.PolicyActionRefused:
+		r.Rcode = dns.RcodeRefused
+		return r
+	case policy.PolicyActionNXDomain:
+		r.Rcode = dns.RcodeNameError
+	case policy.PolicyActionBlackhole:
+		r.Answer = s.addrRRs(q, blackholeAddrs)
+	case policy.PolicyActionAddress:
+		r.Answer = s.addrRRs(q, action.Addrs)
+	}
+
+	if len(r.Answer) == 0 && len(q.Question) == 1 { // NXDOMAIN or NODATA
+		r.Ns = []dns.RR{s.soa(q.Question[0].Name)}
+	}
+	return r
+}
+
+// addrRRs returns A or AAAA records of addrs that have the type of q.
+func (s *synthesizer) addrRRs(q *dns.Msg, addrs []net.IP) []dns.RR {
+	if len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET {
+		return nil
+	}
+	question := q.Question[0]
+
+	var rrs []dns.RR
+	for _, ip := range addrs {
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: s.ttl}
+		ip4 := ip.To4()
+		switch {
+		case question.Qtype == dns.TypeA && ip4 != nil:
+			rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+		case question.Qtype == dns.TypeAAAA && ip4 == nil:
+			rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return rrs
+}
+
+func (s *synthesizer) soa(name string) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: s.ttl},
+		Ns:      s.mName,
+		Mbox:    s.rName,
+		Serial:  1,
+		Refresh: 1800,
+		Retry:   900,
+		Expire:  604800,
+		Minttl:  s.ttl,
+	}
+}
+
+// alias returns a reply to q that has a CNAME to target and the answers
+// of tr, which is the reply of target.
+func (s *synthesizer) alias(q, tr *dns.Msg, target string) *dns.Msg {
+	if s == nil {
+		s = defaultSynthesizer
+	}
+
+	r := new(dns.Msg)
+	r.SetReply(q)
+	r.Rcode = tr.Rcode
+	r.RecursionAvailable = tr.RecursionAvailable
+	cname := &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: s.ttl},
+		Target: target,
+	}
+	r.Answer = append([]dns.RR{cname}, tr.Answer...)
+	r.Ns = tr.Ns
+	r.Extra = tr.Extra
+	return r
+}
@@ -0,0 +1,78 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/policy"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func Test_synthesizer_reply(t *testing.T) {
+	c := new(config.Config)
+	c.Synthesize.TTL = 60
+	s := newSynthesizer(c)
+
+	newQuery := func(qtype uint16) *dns.Msg {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", qtype)
+		return q
+	}
+	addr := &policy.Action{Mode: policy.PolicyActionAddress, Addrs: []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("::1")}}
+
+	tests := []struct {
+		name       string
+		q          *dns.Msg
+		action     *policy.Action
+		wantRcode  int
+		wantAnswer string // empty means NODATA
+	}{
+		{"nxdomain", newQuery(dns.TypeA), &policy.Action{Mode: policy.PolicyActionNXDomain}, dns.RcodeNameError, ""},
+		{"nodata", newQuery(dns.TypeA), &policy.Action{Mode: policy.PolicyActionNoData}, dns.RcodeSuccess, ""},
+		{"blackhole A", newQuery(dns.TypeA), &policy.Action{Mode: policy.PolicyActionBlackhole}, dns.RcodeSuccess, "0.0.0.0"},
+		{"blackhole AAAA", newQuery(dns.TypeAAAA), &policy.Action{Mode: policy.PolicyActionBlackhole}, dns.RcodeSuccess, "::"},
+		{"address A", newQuery(dns.TypeA), addr, dns.RcodeSuccess, "1.2.3.4"},
+		{"address AAAA", newQuery(dns.TypeAAAA), addr, dns.RcodeSuccess, "::1"},
+		{"address MX", newQuery(dns.TypeMX), addr, dns.RcodeSuccess, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := s.reply(tt.q, tt.action)
+			if r.Rcode != tt.wantRcode {
+				t.Fatalf("want rcode %d, got %d", tt.wantRcode, r.Rcode)
+			}
+
+			if len(tt.wantAnswer) == 0 {
+				if len(r.Answer) != 0 {
+					t.Fatalf("want no answer, got %v", r.Answer)
+				}
+				if len(r.Ns) != 1 || r.Ns[0].(*dns.SOA).Minttl != 60 {
+					t.Fatalf("want a soa, got %v", r.Ns)
+				}
+				return
+			}
+
+			ips := msgIPs(r, "")
+			if len(ips) != 1 || !ips[0].Equal(net.ParseIP(tt.wantAnswer)) || r.Answer[0].Header().Ttl != 60 {
+				t.Fatalf("want answer %s, got %v", tt.wantAnswer, r.Answer)
+			}
+		})
+	}
+}
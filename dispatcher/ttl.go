@@ -0,0 +1,98 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"fmt"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/matcher/domain"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/policy"
+	"github.com/miekg/dns"
+	"strings"
+)
+
+// ttlRewriter clamps ttls of answers.
+type ttlRewriter struct {
+	min, max  uint32
+	overrides []*ttlOverride
+}
+
+type ttlOverride struct {
+	matcher  domain.MatcherGroup
+	min, max uint32
+}
+
+// newTTLRewriter returns a nil rewriter if it is not configured.
+func newTTLRewriter(c *config.Config) (*ttlRewriter, error) {
+	tc := &c.TTL
+	if tc.Min == 0 && tc.Max == 0 && len(tc.Override) == 0 {
+		return nil, nil
+	}
+	if err := checkTTLBounds(tc.Min, tc.Max); err != nil {
+		return nil, err
+	}
+
+	t := &ttlRewriter{min: tc.Min, max: tc.Max}
+	for i, oc := range tc.Override {
+		if err := checkTTLBounds(oc.Min, oc.Max); err != nil {
+			return nil, fmt.Errorf("override #%d: %w", i, err)
+		}
+		mg, err := policy.LoadDomainMatchers(oc.Domain, oc.File)
+		if err != nil {
+			return nil, fmt.Errorf("override #%d: %w", i, err)
+		}
+		t.overrides = append(t.overrides, &ttlOverride{matcher: mg, min: oc.Min, max: oc.Max})
+	}
+	return t, nil
+}
+
+func checkTTLBounds(min, max uint32) error {
+	if max != 0 && min > max {
+		return fmt.Errorf("min ttl %d is greater than max ttl %d", min, max)
+	}
+	return nil
+}
+
+// rewrite clamps ttls of r's answers by the bounds of q's domain.
+func (t *ttlRewriter) rewrite(q, r *dns.Msg) {
+	min, max := t.min, t.max
+	if len(q.Question) == 1 {
+		name := strings.ToLower(q.Question[0].Name)
+		for _, o := range t.overrides {
+			if o.matcher.Match(name) {
+				min, max = o.min, o.max
+				break
+			}
+		}
+	}
+
+	for _, rr := range r.Answer {
+		rr.Header().Ttl = clampTTL(rr.Header().Ttl, min, max)
+	}
+}
+
+// clampTTL clamps ttl to [min, max]. 0 means no limit.
+func clampTTL(ttl, min, max uint32) uint32 {
+	if ttl < min {
+		return min
+	}
+	if max != 0 && ttl > max {
+		return max
+	}
+	return ttl
+}
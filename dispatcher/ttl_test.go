@@ -0,0 +1,65 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/miekg/dns"
+	"net"
+	"testing"
+)
+
+func Test_ttlRewriter(t *testing.T) {
+	c := new(config.Config)
+	c.TTL.Min = 60
+	c.TTL.Max = 3600
+	c.TTL.Override = []*config.TTLOverride{{Domain: []string{"cdn.example"}, Min: 5}}
+	tr, err := newTTLRewriter(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		qName   string
+		ttl     uint32
+		wantTTL uint32
+	}{
+		{"example.com.", 1, 60},
+		{"example.com.", 86400, 3600},
+		{"example.com.", 300, 300},
+		{"a.cdn.example.", 1, 5},
+		{"a.cdn.example.", 86400, 86400}, // the override has no max
+	}
+	for _, tt := range tests {
+		q := new(dns.Msg)
+		q.SetQuestion(tt.qName, dns.TypeA)
+		r := new(dns.Msg)
+		r.SetReply(q)
+		r.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: tt.qName, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: tt.ttl}, A: net.ParseIP("1.1.1.1")}}
+
+		tr.rewrite(q, r)
+		if got := r.Answer[0].Header().Ttl; got != tt.wantTTL {
+			t.Fatalf("%s ttl %d: want %d, got %d", tt.qName, tt.ttl, tt.wantTTL, got)
+		}
+	}
+
+	c.TTL.Min = 7200
+	if _, err := newTTLRewriter(c); err == nil {
+		t.Fatal("min greater than max should be rejected")
+	}
+}
@@ -24,29 +24,46 @@ import (
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/logger"
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/policy"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/server"
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/upstream"
 	"github.com/miekg/dns"
 	"net"
+	"sort"
+	"strings"
+	"time"
 )
 
 // upstreamEntry represents a mos-chinadns upstream.
 type upstreamEntry struct {
-	name string
+	name     string
+	priority int
 
 	policies struct {
 		query struct {
+			client           *policy.IPPolicies
+			qtype            *policy.QtypePolicies
 			unhandlableTypes *policy.Action
 			Domain           *policy.DomainPolicies
 		}
+		error *errorPolicy
 		reply struct {
-			errorRcode *policy.Action
+			errorRcode *policy.RcodePolicies
+			bogusIP    *policy.IPPolicies
 			cname      *policy.DomainPolicies
 			withoutIP  *policy.Action
 			ip         *policy.IPPolicies
+
+			ipMode          policy.IPMatchMode
+			ipFinalNameOnly bool
 		}
 	}
 
 	backend upstream.Upstream
+	timeout time.Duration // of the backend, 0 means no limit
+	synth   *synthesizer
+
+	pipeline sequence       // nil means defaultPipeline
+	modifier *replyModifier // can be nil
 }
 
 // newEntry inits a upstream instance.
@@ -57,14 +74,33 @@ func (d *Dispatcher) newEntry(name string, uc *config.UpstreamEntryConfig) (*ups
 
 	entry := new(upstreamEntry)
 	entry.name = name
+	entry.priority = uc.Priority
 
 	backend, ok := d.servers[uc.ServerTag]
 	if !ok {
 		return nil, fmt.Errorf("can not find server with tag [%s]", uc.ServerTag)
 	}
 	entry.backend = backend
+	entry.timeout = time.Duration(uc.Timeout) * time.Millisecond
+	entry.synth = d.synth
 
 	// load policies
+	if !uc.Policies.Query.Client.IsEmpty() {
+		p, err := policy.NewIPPoliciesFromConfig(&uc.Policies.Query.Client, d.servers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client policies, %w", err)
+		}
+		entry.policies.query.client = p
+	}
+
+	if len(uc.Policies.Query.QType) != 0 {
+		p, err := policy.NewQtypePolicies(uc.Policies.Query.QType, d.servers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load qtype policies, %w", err)
+		}
+		entry.policies.query.qtype = p
+	}
+
 	if len(uc.Policies.Query.UnhandlableTypes) != 0 {
 		action, err := policy.NewAction(uc.Policies.Query.UnhandlableTypes, d.servers)
 		if err != nil {
@@ -73,24 +109,40 @@ func (d *Dispatcher) newEntry(name string, uc *config.UpstreamEntryConfig) (*ups
 		entry.policies.query.unhandlableTypes = action
 	}
 
-	if len(uc.Policies.Query.Domain) != 0 {
-		p, err := policy.NewDomainPolicies(uc.Policies.Query.Domain, d.servers)
+	if !uc.Policies.Query.Domain.IsEmpty() {
+		p, err := policy.NewDomainPoliciesFromConfig(&uc.Policies.Query.Domain, d.servers)
 		if err != nil {
 			return nil, fmt.Errorf("failed to load domain policies, %w", err)
 		}
 		entry.policies.query.Domain = p
 	}
 
+	if len(uc.Policies.Error) != 0 {
+		p, err := newErrorPolicy(uc.Policies.Error, d.servers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load error policy, %w", err)
+		}
+		entry.policies.error = p
+	}
+
 	if len(uc.Policies.Reply.ErrorRcode) != 0 {
-		action, err := policy.NewAction(uc.Policies.Reply.ErrorRcode, d.servers)
+		p, err := policy.NewRcodePolicies(uc.Policies.Reply.ErrorRcode, d.servers)
 		if err != nil {
-			return nil, fmt.Errorf("invalid err rcode action [%s]: %w", uc.Policies.Reply.ErrorRcode, err)
+			return nil, fmt.Errorf("failed to load error rcode policies, %w", err)
 		}
-		entry.policies.reply.errorRcode = action
+		entry.policies.reply.errorRcode = p
 	}
 
-	if len(uc.Policies.Reply.CNAME) != 0 {
-		p, err := policy.NewDomainPolicies(uc.Policies.Reply.CNAME, d.servers)
+	if !uc.Policies.Reply.BogusIP.IsEmpty() {
+		p, err := policy.NewIPPoliciesFromConfig(&uc.Policies.Reply.BogusIP, d.servers)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load bogus ip policies, %w", err)
+		}
+		entry.policies.reply.bogusIP = p
+	}
+
+	if !uc.Policies.Reply.CNAME.IsEmpty() {
+		p, err := policy.NewDomainPoliciesFromConfig(&uc.Policies.Reply.CNAME, d.servers)
 		if err != nil {
 			return nil, fmt.Errorf("failed to load cname policies, %w", err)
 		}
@@ -105,155 +157,172 @@ func (d *Dispatcher) newEntry(name string, uc *config.UpstreamEntryConfig) (*ups
 		entry.policies.reply.withoutIP = action
 	}
 
-	if len(uc.Policies.Reply.IP) != 0 {
-		p, err := policy.NewIPPolicies(uc.Policies.Reply.IP, d.servers)
+	if !uc.Policies.Reply.IP.IsEmpty() {
+		p, err := policy.NewIPPoliciesFromConfig(&uc.Policies.Reply.IP, d.servers)
 		if err != nil {
 			return nil, fmt.Errorf("failed to load ip policies, %w", err)
 		}
 		entry.policies.reply.ip = p
 	}
 
+	ipMode, err := policy.ParseIPMatchMode(uc.Policies.Reply.IPMode)
+	if err != nil {
+		return nil, err
+	}
+	entry.policies.reply.ipMode = ipMode
+	entry.policies.reply.ipFinalNameOnly = uc.Policies.Reply.IPFinalNameOnly
+
+	entry.modifier, err = newReplyModifier(uc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load reply modifier, %w", err)
+	}
+
+	pipeline := uc.Pipeline
+	if len(pipeline) == 0 && d.config != nil {
+		pipeline = d.config.Pipeline
+	}
+	if len(pipeline) != 0 {
+		seq, err := d.newSequence(pipeline, make(map[string]bool))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load pipeline, %w", err)
+		}
+		entry.pipeline = seq
+	}
+
 	return entry, nil
 }
 
+// sortEntries sorts entries by priority, from high to low.
+// Entries with the same priority are sorted by name.
+func sortEntries(entries []*upstreamEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].priority != entries[j].priority {
+			return entries[i].priority > entries[j].priority
+		}
+		return entries[i].name < entries[j].name
+	})
+}
+
 func isUnhandlableType(q *dns.Msg) bool {
 	return q.Opcode != dns.OpcodeQuery || len(q.Question) != 1 || q.Question[0].Qclass != dns.ClassINET || (q.Question[0].Qtype != dns.TypeA && q.Question[0].Qtype != dns.TypeAAAA)
 }
 
-func (u *upstreamEntry) Exchange(ctx context.Context, q *dns.Msg) (r *dns.Msg, err error) {
-	return u.exchange(ctx, q)
+func (u *upstreamEntry) Exchange(ctx context.Context, q *dns.Msg, meta *server.RequestMeta) (r *dns.Msg, err error) {
+	return u.exchange(ctx, q, meta)
 }
 
-func (u *upstreamEntry) exchange(ctx context.Context, q *dns.Msg) (r *dns.Msg, err error) {
-
-	// check query
-	// check msg type
-	if isUnhandlableType(q) {
-		if action := u.policies.query.unhandlableTypes; action != nil {
-			logger.GetStd().Debugf("upstream %s: [%v %d]: query is unhandlable type, action [%s]", u.name, q.Question, q.Id, action.Mode)
-			switch action.Mode {
-			case policy.PolicyActionAccept:
-				return u.backend.Exchange(ctx, q)
-			case policy.PolicyActionDeny:
-				return nil, nil
-			case policy.PolicyActionRedirect:
-				return action.Redirect.Exchange(ctx, q)
-			default:
-				return nil, fmt.Errorf("unexpected unhandlableTypes action [%s]", action.Mode)
-			}
-		}
+func (u *upstreamEntry) exchange(ctx context.Context, q *dns.Msg, meta *server.RequestMeta) (r *dns.Msg, err error) {
+	pipeline := u.pipeline
+	if pipeline == nil {
+		pipeline = defaultPipeline
 	}
 
-	// check domain
-	if u.policies.query.Domain != nil {
-		if action := u.policies.query.Domain.Match(q.Question[0].Name); action != nil {
-			logger.GetStd().Debugf("upstream %s: [%v %d]: query is matched by domain, action [%s]", u.name, q.Question, q.Id, action.Mode)
-			switch action.Mode {
-			case policy.PolicyActionAccept:
-				return u.backend.Exchange(ctx, q)
-			case policy.PolicyActionDeny:
-				return nil, nil
-			default:
-				return nil, fmt.Errorf("unexpected domain action [%s]", action.Mode)
-			}
-		}
+	s := &pipelineState{q: q, meta: meta}
+	done, r, err := pipeline.exec(ctx, u, s)
+	if !done { // default accept
+		r, err = s.r, nil
 	}
 
-	// send to upstream
-	r, err = u.backend.Exchange(ctx, q)
-	if err != nil {
-		return nil, err
+	if u.modifier != nil && r != nil && err == nil {
+		u.modifyReply(ctx, q, r)
 	}
+	return r, err
+}
 
-	// check reply
-	// check Rcode
-	if r.Rcode != dns.RcodeSuccess {
-		if action := u.policies.reply.errorRcode; action != nil {
-			logger.GetStd().Debugf("upstream %s: [%v %d]: reply has a error rcode, action [%s]", u.name, q.Question, q.Id, action.Mode)
-			switch action.Mode {
-			case policy.PolicyActionAccept:
-				return r, nil
-			case policy.PolicyActionDeny:
-				return nil, nil
-			case policy.PolicyActionRedirect:
-				return action.Redirect.Exchange(ctx, q)
-			default:
-				return nil, fmt.Errorf("unexpected errorRcode action [%s]", action.Mode)
-			}
-		}
+// queryBackend sends q to the backend within the entry's timeout.
+func (u *upstreamEntry) queryBackend(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if u.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, u.timeout)
+		defer cancel()
 	}
+	return u.backend.Exchange(ctx, q)
+}
 
-	// check CNAME
-	if u.policies.reply.cname != nil {
-		if action := checkMsgCNAME(u.policies.reply.cname, r); action != nil {
-			logger.GetStd().Debugf("upstream %s: [%v %d]: reply cname matched, action [%s]", u.name, q.Question, q.Id, action.Mode)
-			switch action.Mode {
-			case policy.PolicyActionAccept:
-				return r, nil
-			case policy.PolicyActionDeny:
-				return nil, nil
-			case policy.PolicyActionRedirect:
-				return action.Redirect.Exchange(ctx, q)
-			default:
-				return nil, fmt.Errorf("unexpected cname action [%s]", action.Mode)
-			}
-		}
+// handleError applies the error policy to err from the backend.
+func (u *upstreamEntry) handleError(ctx context.Context, q *dns.Msg, err error) (*dns.Msg, error) {
+	if ctx.Err() != nil { // the query is cancelled or timed out, not the backend
+		return nil, err
 	}
 
-	// check ip
-	if checkMsgHasValidIP(r) == false {
-		if action := u.policies.reply.withoutIP; action != nil {
-			logger.GetStd().Debugf("upstream %s: [%v %d]: reply don not has any valid ip, action [%s]", u.name, q.Question, q.Id, action.Mode)
-			switch action.Mode {
-			case policy.PolicyActionAccept:
-				return r, nil
-			case policy.PolicyActionDeny:
-				return nil, nil
-			case policy.PolicyActionRedirect:
-				return action.Redirect.Exchange(ctx, q)
-			default:
-				return nil, fmt.Errorf("unexpected cname action [%s]", action.Mode)
-			}
-		}
+	kind := errorKind(err)
+	if action := u.policies.error.match(kind); action != nil {
+		logger.GetStd().Debugf("upstream %s: [%v %d]: %s error: %v, action [%s]", u.name, q.Question, q.Id, kind, err, action.Mode)
+		return u.doAction(ctx, q, nil, action)
 	}
+	return nil, err
+}
 
-	if u.policies.reply.ip != nil {
-		if action := checkMsgIP(u.policies.reply.ip, r); action != nil {
-			logger.GetStd().Debugf("upstream %s: [%v %d]: reply ip matched, action [%s]", u.name, q.Question, q.Id, action.Mode)
-			switch action.Mode {
-			case policy.PolicyActionAccept:
-				return r, nil
-			case policy.PolicyActionDeny:
-				return nil, nil
-			case policy.PolicyActionRedirect:
-				return action.Redirect.Exchange(ctx, q)
-			default:
-				return nil, fmt.Errorf("unexpected ip action [%s]", action.Mode)
+// doAction applies the action to q. r is the reply from the backend. If r
+// is nil, the action is from a query policy and accept sends q to the backend.
+func (u *upstreamEntry) doAction(ctx context.Context, q, r *dns.Msg, action *policy.Action) (*dns.Msg, error) {
+	switch {
+	case action.Mode == policy.PolicyActionAccept:
+		if r == nil {
+			r, err := u.queryBackend(ctx, q)
+			if err != nil {
+				return u.handleError(ctx, q, err)
 			}
+			return r, nil
 		}
+		return r, nil
+	case action.Mode == policy.PolicyActionDeny:
+		return nil, nil
+	case action.Mode == policy.PolicyActionRedirect:
+		return action.Redirect.Exchange(ctx, q)
+	case action.Mode.IsSynthesized():
+		return u.synth.reply(q, action), nil
+	default:
+		return nil, fmt.Errorf("unexpected action [%s]", action.Mode)
 	}
+}
 
-	// default accept
-	return r, nil
+// checkMsgIP checks ip RRs in m's answer section by the ip policies.
+func (u *upstreamEntry) checkMsgIP(q, m *dns.Msg) *policy.Action {
+	var ips []net.IP
+	if u.policies.reply.ipFinalNameOnly && len(q.Question) == 1 {
+		ips = msgIPs(m, finalName(m, q.Question[0].Name))
+	} else {
+		ips = msgIPs(m, "")
+	}
+	return u.policies.reply.ip.MatchIPs(ips, u.policies.reply.ipMode)
 }
 
-// checkMsgIP checks m's ip RR in answer section. If ip is a
-func checkMsgIP(p *policy.IPPolicies, m *dns.Msg) *policy.Action {
+// msgIPs returns addresses of A and AAAA records in m's answer section.
+// If owner is not empty, only records with this name are returned.
+func msgIPs(m *dns.Msg, owner string) []net.IP {
+	var ips []net.IP
 	for i := range m.Answer {
-		var ip net.IP
+		if len(owner) != 0 && !strings.EqualFold(m.Answer[i].Header().Name, owner) {
+			continue
+		}
 		switch rr := m.Answer[i].(type) {
 		case *dns.A:
-			ip = rr.A
+			ips = append(ips, rr.A)
 		case *dns.AAAA:
-			ip = rr.AAAA
-		default:
-			continue
+			ips = append(ips, rr.AAAA)
 		}
+	}
+	return ips
+}
 
-		action := p.Match(ip)
-		return action
+// finalName follows the CNAME chain in m's answer section from name
+// and returns the last name of the chain.
+func finalName(m *dns.Msg, name string) string {
+	for hop := 0; hop < len(m.Answer); hop++ { // the chain can't be longer than the answer section
+		next := ""
+		for i := range m.Answer {
+			if cname, ok := m.Answer[i].(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				next = cname.Target
+				break
+			}
+		}
+		if len(next) == 0 {
+			break
+		}
+		name = next
 	}
-	return nil
+	return name
 }
 
 func checkMsgCNAME(p *policy.DomainPolicies, m *dns.Msg) *policy.Action {
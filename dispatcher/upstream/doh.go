@@ -23,6 +23,7 @@ import (
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/logger"
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/utils"
 	"io"
 	"net"
@@ -31,6 +32,7 @@ import (
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -42,9 +44,17 @@ import (
 type upstreamDoH struct {
 	urlTemplate string
 	client      *http.Client
+
+	lastUsed int64 // unix nano time of last successful exchange, atomic
+
+	handshakeStats handshakeStats
 }
 
 func NewDoHUpstream(urlEndpoint, addr, socks5 string, tlsConfig *tls.Config) (Upstream, error) {
+	return newDoHUpstream(urlEndpoint, addr, socks5, false, tlsConfig)
+}
+
+func newDoHUpstream(urlEndpoint, addr, socks5 string, fastOpen bool, tlsConfig *tls.Config) (*upstreamDoH, error) {
 	// check urlTemplate
 	u, err := url.ParseRequestURI(urlEndpoint)
 	if err != nil {
@@ -63,33 +73,15 @@ func NewDoHUpstream(urlEndpoint, addr, socks5 string, tlsConfig *tls.Config) (Up
 		urlEndpoint = urlEndpoint + "&dns=" // the last arg
 	}
 
-	dialTLS := func(_, _ string, cfg *tls.Config) (c net.Conn, err error) {
-		if len(socks5) != 0 {
-			dialCtx, cancel := context.WithTimeout(context.Background(), dialTCPTimeout)
-			defer cancel()
-			c, err = dialTCPViaSocks5(dialCtx, "tcp", addr, socks5)
-			if err != nil {
-				return nil, fmt.Errorf("failed to dial socks5 connection: %w", err)
-			}
-		} else {
-			d := net.Dialer{Timeout: dialTCPTimeout}
-			c, err = d.Dial("tcp", addr)
-			if err != nil {
-				return nil, fmt.Errorf("failed to dial tcp connection: %w", err)
-			}
-		}
-
-		tlsConn := tls.Client(c, cfg)
-		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
-		// handshake now
-		if err := tlsConn.Handshake(); err != nil {
-			tlsConn.Close()
-			return nil, fmt.Errorf("tls handshake failed: %w", err)
+	c := new(upstreamDoH)
+	dialTLS := func(_, _ string, cfg *tls.Config) (net.Conn, error) {
+		dialCtx, cancel := context.WithTimeout(context.Background(), dialTCPTimeout)
+		defer cancel()
+		conn, err := dialTCP(dialCtx, addr, socks5, fastOpen)
+		if err != nil {
+			return nil, err
 		}
-		tlsConn.SetDeadline(time.Time{})
-		c = tlsConn
-
-		return c, nil
+		return tlsHandshake(conn, cfg, &c.handshakeStats)
 	}
 
 	t2 := &http2.Transport{
@@ -112,7 +104,6 @@ func NewDoHUpstream(urlEndpoint, addr, socks5 string, tlsConfig *tls.Config) (Up
 		ExpectContinueTimeout: time.Second * 2,
 	}
 
-	c := new(upstreamDoH)
 	c.urlTemplate = urlEndpoint
 	c.client = &http.Client{
 		Transport: t2,
@@ -121,10 +112,10 @@ func NewDoHUpstream(urlEndpoint, addr, socks5 string, tlsConfig *tls.Config) (Up
 	return c, nil
 }
 
-//Exchange: DoH upstream has its own context to control timeout, it will not follow the ctx.
-func (u *upstreamDoH) Exchange(_ context.Context, q *dns.Msg) (r *dns.Msg, err error) {
-
-	ctx, cancel := context.WithTimeout(context.Background(), dohIOTimeout)
+// Exchange: the query is cancelled if ctx is done or it doesn't finish
+// within dohIOTimeout.
+func (u *upstreamDoH) Exchange(ctx context.Context, q *dns.Msg) (r *dns.Msg, err error) {
+	ctx, cancel := context.WithTimeout(ctx, dohIOTimeout)
 	defer cancel()
 
 	buf, err := utils.GetMsgBufFor(q)
@@ -167,9 +158,50 @@ func (u *upstreamDoH) Exchange(_ context.Context, q *dns.Msg) (r *dns.Msg, err e
 	}
 	// change the id back
 	r.Id = q.Id
+	atomic.StoreInt64(&u.lastUsed, time.Now().UnixNano())
 	return r, nil
 }
 
+// KeepWarm opens the connection immediately and keeps it open by sending
+// a probe query if the upstream has been idle for interval.
+// http2 multiplexes all queries on one connection, so there is always
+// at most one warm connection. Like warm tcp connections, it keeps the
+// connection warm for the lifetime of the program.
+func (u *upstreamDoH) KeepWarm(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go u.keepWarm(interval)
+}
+
+func (u *upstreamDoH) keepWarm(interval time.Duration) {
+	probe := new(dns.Msg)
+	probe.SetQuestion(".", dns.TypeNS)
+
+	retryInterval := warmRetryMinInterval
+	for {
+		idle := time.Since(time.Unix(0, atomic.LoadInt64(&u.lastUsed)))
+		if idle < interval {
+			time.Sleep(interval - idle)
+			continue
+		}
+
+		start := time.Now()
+		_, err := u.Exchange(context.Background(), probe)
+		if err != nil {
+			logger.GetStd().Warnf("doh: warm up probe failed, retry in %s: %v", retryInterval, err)
+			time.Sleep(retryInterval)
+			retryInterval = retryInterval * 2
+			if retryInterval > interval {
+				retryInterval = interval
+			}
+			continue
+		}
+		retryInterval = warmRetryMinInterval
+		logger.GetStd().Debugf("doh: warm up probe finished in %dms", time.Since(start).Milliseconds())
+	}
+}
+
 func (u *upstreamDoH) doHTTP(ctx context.Context, url string) (*dns.Msg, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
@@ -0,0 +1,50 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package upstream
+
+import (
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/utils"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultPaddingBlockSize is the recommended block size for queries.
+	// See https://tools.ietf.org/html/rfc8467 4.1
+	defaultPaddingBlockSize = 128
+)
+
+// padQuery returns a copy of q that is padded to a multiple of blockSize (RFC 7830).
+// optAdded indicates that q doesn't have an OPT and a new one was added.
+func padQuery(q *dns.Msg, blockSize int) (padded *dns.Msg, optAdded bool) {
+	padded = q.Copy()
+	opt, optAdded := utils.UpgradeEDNS0(padded)
+	utils.PadEDNS0(padded, opt, blockSize)
+	return padded, optAdded
+}
+
+// unpadReply removes the padding from r. If the OPT was added
+// by padQuery, it will be removed as well.
+func unpadReply(r *dns.Msg, optAdded bool) {
+	if optAdded {
+		utils.RemoveEDNS0(r)
+		return
+	}
+	if opt := r.IsEdns0(); opt != nil {
+		utils.RemoveEDNS0Option(opt, dns.EDNS0PADDING)
+	}
+}
@@ -0,0 +1,175 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package upstream
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/logger"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCacheSize          = 64
+	sessionCacheFlushInterval = time.Second * 10
+)
+
+// fileSessionCache is a tls.ClientSessionCache that saves sessions
+// to a file, so sessions can be resumed after a restart.
+// The file contains session secrets, it will be created with 0600 permission.
+type fileSessionCache struct {
+	file string
+	lru  tls.ClientSessionCache
+
+	sync.Mutex
+	sessions map[string]*encodedSession
+	dirty    bool
+}
+
+type encodedSession struct {
+	Ticket []byte `json:"ticket"`
+	State  []byte `json:"state"`
+}
+
+var (
+	fileSessionCachesLock sync.Mutex
+	fileSessionCaches     = make(map[string]*fileSessionCache) // key is the cleaned file path
+)
+
+// getFileSessionCache returns the cache of the file. Servers that use the
+// same file share one cache, so they don't overwrite each other's sessions.
+func getFileSessionCache(file string) (*fileSessionCache, error) {
+	file = filepath.Clean(file)
+
+	fileSessionCachesLock.Lock()
+	defer fileSessionCachesLock.Unlock()
+	if c, ok := fileSessionCaches[file]; ok {
+		return c, nil
+	}
+	c, err := newFileSessionCache(file)
+	if err != nil {
+		return nil, err
+	}
+	fileSessionCaches[file] = c
+	return c, nil
+}
+
+func newFileSessionCache(file string) (*fileSessionCache, error) {
+	c := &fileSessionCache{
+		file:     file,
+		lru:      tls.NewLRUClientSessionCache(sessionCacheSize),
+		sessions: make(map[string]*encodedSession),
+	}
+
+	b, err := ioutil.ReadFile(file)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(b, &c.sessions); err != nil {
+			return nil, fmt.Errorf("invalid session file: %w", err)
+		}
+		for key, es := range c.sessions {
+			cs, err := decodeSession(es)
+			if err != nil { // sessions from other go versions may be invalid
+				logger.GetStd().Debugf("session cache: ignored session for %s: %v", key, err)
+				delete(c.sessions, key)
+				continue
+			}
+			c.lru.Put(key, cs)
+		}
+	}
+
+	go c.flushLoop()
+	return c, nil
+}
+
+func (c *fileSessionCache) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return c.lru.Get(sessionKey)
+}
+
+func (c *fileSessionCache) Put(sessionKey string, cs *tls.ClientSessionState) {
+	c.lru.Put(sessionKey, cs)
+
+	c.Lock()
+	defer c.Unlock()
+	if cs == nil {
+		delete(c.sessions, sessionKey)
+		c.dirty = true
+		return
+	}
+
+	es, err := encodeSession(cs)
+	if err != nil {
+		logger.GetStd().Debugf("session cache: can not save session for %s: %v", sessionKey, err)
+		return
+	}
+	c.sessions[sessionKey] = es
+	c.dirty = true
+}
+
+func (c *fileSessionCache) flushLoop() {
+	ticker := time.NewTicker(sessionCacheFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := c.flush(); err != nil {
+			logger.GetStd().Warnf("session cache: failed to save sessions to %s: %v", c.file, err)
+		}
+	}
+}
+
+func (c *fileSessionCache) flush() error {
+	c.Lock()
+	if !c.dirty {
+		c.Unlock()
+		return nil
+	}
+	b, err := json.Marshal(c.sessions)
+	c.dirty = false
+	c.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(c.file, b)
+}
+
+// writeFileAtomic writes b to a temp file with 0600 permission and
+// replaces the file with it, so a crash can't leave a broken file.
+func writeFileAtomic(file string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
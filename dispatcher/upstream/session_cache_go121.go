@@ -0,0 +1,42 @@
+// +build go1.21
+
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package upstream
+
+import "crypto/tls"
+
+func encodeSession(cs *tls.ClientSessionState) (*encodedSession, error) {
+	ticket, state, err := cs.ResumptionState()
+	if err != nil {
+		return nil, err
+	}
+	b, err := state.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	return &encodedSession{Ticket: ticket, State: b}, nil
+}
+
+func decodeSession(es *encodedSession) (*tls.ClientSessionState, error) {
+	state, err := tls.ParseSessionState(es.State)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewResumptionState(es.Ticket, state)
+}
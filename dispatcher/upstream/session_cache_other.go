@@ -0,0 +1,35 @@
+// +build !go1.21
+
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package upstream
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+var errSessionEncodingNotSupported = errors.New("saving tls sessions needs go1.21 or later")
+
+func encodeSession(_ *tls.ClientSessionState) (*encodedSession, error) {
+	return nil, errSessionEncodingNotSupported
+}
+
+func decodeSession(_ *encodedSession) (*tls.ClientSessionState, error) {
+	return nil, errSessionEncodingNotSupported
+}
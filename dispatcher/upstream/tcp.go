@@ -20,7 +20,6 @@ package upstream
 import (
 	"context"
 	"crypto/tls"
-	"fmt"
 	"net"
 	"time"
 
@@ -33,6 +32,9 @@ type tcpUpstream struct {
 	addr, socks5 string
 	isTLS        bool
 	tlsConf      *tls.Config
+	fastOpen     bool
+
+	handshakeStats handshakeStats
 
 	cp *tcpClient.Client
 }
@@ -75,31 +77,15 @@ func (u *tcpUpstream) dial() (conn net.Conn, err error) {
 func (u *tcpUpstream) dialContext(ctx context.Context) (conn net.Conn, err error) {
 
 	// dial tcp connection
-	if len(u.socks5) != 0 {
-		conn, err = dialTCPViaSocks5(ctx, "tcp", u.addr, u.socks5)
-		if err != nil {
-			return nil, fmt.Errorf("failed to dial socks5 connection: %w", err)
-		}
-	} else {
-		d := net.Dialer{}
-		conn, err = d.DialContext(ctx, "tcp", u.addr)
-		if err != nil {
-			return nil, fmt.Errorf("failed to dial tcp connection: %w", err)
-		}
+	conn, err = dialTCP(ctx, u.addr, u.socks5, u.fastOpen)
+	if err != nil {
+		return nil, err
 	}
 
 	// upgrade to tls
 	if u.isTLS {
-		tlsConn := tls.Client(conn, u.tlsConf)
-		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
-		// handshake now
-		if err := tlsConn.Handshake(); err != nil {
-			tlsConn.Close()
-			return nil, fmt.Errorf("tls handshake failed: %w", err)
-		}
-		tlsConn.SetDeadline(time.Time{})
-		conn = tlsConn
+		return tlsHandshake(conn, u.tlsConf, &u.handshakeStats)
 	}
 
-	return conn, err
+	return conn, nil
 }
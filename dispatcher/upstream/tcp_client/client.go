@@ -19,10 +19,12 @@ package tcpClient
 
 import (
 	"context"
+	"encoding/binary"
 	"errors"
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/logger"
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/utils"
 	"github.com/miekg/dns"
+	"io"
 	"net"
 	"sync/atomic"
 	"time"
@@ -36,6 +38,13 @@ type Client struct {
 	idleTimeout  time.Duration
 
 	sender chan *query
+
+	workers      int32         // number of running workers
+	workerExited chan struct{} // notifies keepWarm that a worker is exited
+
+	edns0KeepAlive     bool
+	paddingBlockSize   int   // 0 means no padding
+	learnedIdleTimeout int64 // time.Duration, atomic
 }
 
 type query struct {
@@ -53,6 +62,11 @@ type worker struct {
 	pool *Client
 	conn net.Conn
 
+	// below fields are only accessed by the write loop
+	idleTimeout      time.Duration
+	lastActive       time.Time
+	serverAdvertised bool // server has sent a edns0 keepalive timeout
+
 	er                atomic.Value // read err
 	readLoopEventChan chan *dns.Msg
 }
@@ -65,6 +79,164 @@ func New(ctx context.Context, dial func() (net.Conn, error), readTimeout, writeT
 		writeTimeout: writeTimeout,
 		idleTimeout:  idleTimeout,
 		sender:       make(chan *query),
+		workerExited: make(chan struct{}, 1),
+	}
+}
+
+const (
+	warmRetryMinInterval = time.Second
+	warmRetryMaxInterval = time.Second * 30
+
+	// defaultKeepAliveIdleTimeout is used if edns0 keepalive is enabled but
+	// the Client was created without a idle timeout.
+	defaultKeepAliveIdleTimeout = time.Second * 10
+	idleTimeoutMargin           = time.Second
+	// minLearnedIdleTimeout is the floor of learned idle timeouts.
+	// Connections that are closed sooner are not closed by an idle timeout.
+	minLearnedIdleTimeout = time.Second * 2
+	// closeImmediately is the learned idle timeout if the server advertised
+	// a keepalive timeout of 0. A learned value of 0 means nothing is learned.
+	closeImmediately = time.Duration(-1)
+)
+
+// EnableEDNS0KeepAlive makes the Client send the edns0 tcp keepalive option
+// (RFC 7828) and adopt the timeout advertised by the server. If the server
+// doesn't support the option, the Client learns the idle timeout from
+// connections that are closed by the server.
+// It must be called before the Client is used.
+func (p *Client) EnableEDNS0KeepAlive() {
+	p.edns0KeepAlive = true
+	if p.idleTimeout == 0 {
+		p.idleTimeout = defaultKeepAliveIdleTimeout
+	}
+}
+
+// EnablePadding makes the Client pad queries to a multiple of blockSize
+// (RFC 7830) after other options, e.g. the keepalive option, are added.
+// It must be called before the Client is used.
+func (p *Client) EnablePadding(blockSize int) {
+	p.paddingBlockSize = blockSize
+}
+
+// getIdleTimeout returns the idle timeout for new connections.
+func (p *Client) getIdleTimeout() time.Duration {
+	switch learned := time.Duration(atomic.LoadInt64(&p.learnedIdleTimeout)); {
+	case learned == closeImmediately:
+		return 0
+	case learned > 0:
+		return learned
+	}
+	return p.idleTimeout
+}
+
+func (p *Client) setIdleTimeout(d time.Duration) {
+	if old := time.Duration(atomic.SwapInt64(&p.learnedIdleTimeout, int64(d))); old != d {
+		logger.GetStd().Debugf("tcp client: idle timeout changed from %s to %s", old, d)
+	}
+}
+
+// learnIdleTimeout learns the server's idle timeout from a connection
+// that was closed by the server after idle. Only clean closes (EOF) are
+// considered, resets and other errors say nothing about the timeout.
+func (p *Client) learnIdleTimeout(idle time.Duration, err error) {
+	if !errors.Is(err, io.EOF) || idle < minLearnedIdleTimeout {
+		return
+	}
+	d := withMargin(idle)
+	if d < minLearnedIdleTimeout {
+		d = minLearnedIdleTimeout
+	}
+	if d < p.getIdleTimeout() {
+		p.setIdleTimeout(d)
+	}
+}
+
+// growIdleTimeout is called when a connection reached the learned idle
+// timeout and the server didn't close it, so the server's timeout is
+// longer. It doubles the learned timeout until it recovers to the
+// configured one.
+func (p *Client) growIdleTimeout() {
+	learned := time.Duration(atomic.LoadInt64(&p.learnedIdleTimeout))
+	if learned <= 0 {
+		return
+	}
+	if learned*2 >= p.idleTimeout {
+		p.setIdleTimeout(0) // use the configured one
+		return
+	}
+	p.setIdleTimeout(learned * 2)
+}
+
+// withMargin returns a idle timeout that is a little shorter than the
+// server's, so we always close the connection first.
+func withMargin(d time.Duration) time.Duration {
+	if d > idleTimeoutMargin*2 {
+		return d - idleTimeoutMargin
+	}
+	return d / 2
+}
+
+// KeepWarm keeps at least n connections open. Connections are opened
+// immediately, replaced when they reach the idle timeout (before the
+// server closes them) and re-dialed as soon as they are broken.
+// KeepWarm only works if the Client reuses connections (idleTimeout > 0).
+func (p *Client) KeepWarm(n int) error {
+	if p.idleTimeout <= 0 {
+		return errors.New("connection reuse is disabled")
+	}
+	if n > 0 {
+		go p.keepWarm(int32(n))
+	}
+	return nil
+}
+
+// Workers returns the number of open connections.
+func (p *Client) Workers() int {
+	return int(atomic.LoadInt32(&p.workers))
+}
+
+func (p *Client) keepWarm(n int32) {
+	retryInterval := warmRetryMinInterval
+	for {
+		// no warm connections if the server wants connections to be closed
+		// after the reply, workers of queries will update the timeout.
+		for atomic.LoadInt32(&p.workers) < n && p.getIdleTimeout() > 0 {
+			start := time.Now()
+			w, err := p.newWorker()
+			if err != nil {
+				logger.GetStd().Warnf("tcp client: failed to open warm connection, retry in %s: %v", retryInterval, err)
+				select {
+				case <-p.ctx.Done():
+					return
+				case <-time.After(retryInterval):
+				}
+				retryInterval = retryInterval * 2
+				if retryInterval > warmRetryMaxInterval {
+					retryInterval = warmRetryMaxInterval
+				}
+				continue
+			}
+			retryInterval = warmRetryMinInterval
+			logger.GetStd().Debugf("tcp client: warm connection %s -> %s opened in %dms", w.conn.LocalAddr(), w.conn.RemoteAddr(), time.Since(start).Milliseconds())
+			go w.run(nil)
+		}
+
+		filled := time.Now()
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-p.workerExited:
+		}
+
+		// connections that are closed right after they are opened
+		// should not make us dial in a loop
+		if wait := warmRetryMinInterval - time.Since(filled); wait > 0 {
+			select {
+			case <-p.ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
 	}
 }
 
@@ -83,14 +255,19 @@ func (p *Client) handleQueryNoCR(_ context.Context, q *dns.Msg) (r *dns.Msg, err
 	}
 	defer c.Close()
 
+	m, optAdded := p.prepareQuery(q)
 	c.SetWriteDeadline(time.Now().Add(p.writeTimeout))
-	_, err = utils.WriteMsgToTCP(c, q)
+	_, err = utils.WriteMsgToTCP(c, m)
 	if err != nil {
 		return nil, err
 	}
 	c.SetReadDeadline(time.Now().Add(p.readTimeout))
 	r, _, err = utils.ReadMsgFromTCP(c)
-	return r, err
+	if err != nil {
+		return nil, err
+	}
+	p.removeReplyOptions(r, optAdded)
+	return r, nil
 }
 
 // handle query with connection reuse
@@ -121,15 +298,19 @@ func (p *Client) newWorker() (*worker, error) {
 		return nil, err
 	}
 
+	atomic.AddInt32(&p.workers, 1)
 	return &worker{
 		pool:              p,
 		conn:              conn,
+		idleTimeout:       p.getIdleTimeout(),
+		lastActive:        time.Now(),
 		readLoopEventChan: make(chan *dns.Msg, 1),
 	}, nil
 }
 
+// run runs the worker. firstQuery can be nil.
 func (w *worker) run(firstQuery *query) {
-	defer w.conn.Close()
+	defer w.exit()
 	logger.GetStd().Debugf("conn worker %p: %s -> %s is started", w, w.conn.LocalAddr(), w.conn.RemoteAddr())
 
 	// read loop
@@ -141,9 +322,11 @@ func (w *worker) run(firstQuery *query) {
 	}()
 
 	// handle first query
-	if err := w.handleQuery(firstQuery); err != nil {
-		logger.GetStd().Debugf("conn worker %p: exited, %v", w, err)
-		return
+	if firstQuery != nil {
+		if err := w.handleQuery(firstQuery); err != nil {
+			logger.GetStd().Debugf("conn worker %p: exited, %v", w, err)
+			return
+		}
 	}
 
 	// write loop
@@ -153,6 +336,15 @@ func (w *worker) run(firstQuery *query) {
 	}
 }
 
+func (w *worker) exit() {
+	w.conn.Close()
+	atomic.AddInt32(&w.pool.workers, -1)
+	select {
+	case w.pool.workerExited <- struct{}{}:
+	default:
+	}
+}
+
 func (w *worker) readLoop() error {
 	for {
 		r, _, err := utils.ReadMsgFromTCP(w.conn)
@@ -170,7 +362,10 @@ func (w *worker) readLoop() error {
 }
 
 func (w *worker) writeLoop() error {
-	idleTimer := utils.GetTimer(w.pool.idleTimeout)
+	if w.idleTimeout <= 0 {
+		return errors.New("server requested to close the connection")
+	}
+	idleTimer := utils.GetTimer(w.idleTimeout)
 	defer utils.ReleaseTimer(idleTimer)
 
 	for {
@@ -178,11 +373,21 @@ func (w *worker) writeLoop() error {
 		case <-w.pool.ctx.Done():
 			return w.pool.ctx.Err()
 		case <-idleTimer.C:
+			if w.pool.edns0KeepAlive && !w.serverAdvertised {
+				w.pool.growIdleTimeout()
+			}
 			return errors.New("idle timeout")
 		case _, ok := <-w.readLoopEventChan: // idle read, ignore the msg
 			if !ok { // read loop is exited
 				e := w.er.Load()
 				err, _ := e.(error) // read the read err
+
+				// the connection is closed by the server before our idle timeout.
+				if w.pool.edns0KeepAlive && !w.serverAdvertised {
+					if idle := time.Since(w.lastActive); idle < w.idleTimeout {
+						w.pool.learnIdleTimeout(idle, err)
+					}
+				}
 				return err
 			}
 
@@ -190,14 +395,19 @@ func (w *worker) writeLoop() error {
 			if err := w.handleQuery(q); err != nil {
 				return err
 			}
-			utils.ResetAndDrainTimer(idleTimer, w.pool.idleTimeout)
+			if w.idleTimeout <= 0 {
+				return errors.New("server requested to close the connection")
+			}
+			utils.ResetAndDrainTimer(idleTimer, w.idleTimeout)
 		}
 	}
 }
 
 func (w *worker) handleQuery(q *query) error {
+	m, optAdded := w.pool.prepareQuery(q.m)
+
 	w.conn.SetWriteDeadline(time.Now().Add(w.pool.writeTimeout))
-	_, err := utils.WriteMsgToTCP(w.conn, q.m)
+	_, err := utils.WriteMsgToTCP(w.conn, m)
 	if err != nil {
 		select {
 		case q.receiver <- &result{m: nil, err: err}:
@@ -225,6 +435,8 @@ func (w *worker) handleQuery(q *query) error {
 			return err
 		}
 		// got a reply
+		w.lastActive = time.Now()
+		w.handleReplyOptions(r, optAdded)
 		select {
 		case q.receiver <- &result{m: r, err: nil}:
 		default:
@@ -232,3 +444,68 @@ func (w *worker) handleQuery(q *query) error {
 	}
 	return nil
 }
+
+// prepareQuery returns m or a copy of m with the options that the Client
+// adds. optAdded indicates that m doesn't have an OPT and a new one was added.
+func (p *Client) prepareQuery(m *dns.Msg) (prepared *dns.Msg, optAdded bool) {
+	if !p.edns0KeepAlive && p.paddingBlockSize <= 0 {
+		return m, false
+	}
+
+	prepared = m.Copy()
+	opt, optAdded := utils.UpgradeEDNS0(prepared)
+	if p.edns0KeepAlive {
+		setKeepAlive(opt)
+	}
+	if p.paddingBlockSize > 0 { // padding must be the last option
+		utils.PadEDNS0(prepared, opt, p.paddingBlockSize)
+	}
+	return prepared, optAdded
+}
+
+// setKeepAlive adds a edns0 tcp keepalive option to opt.
+func setKeepAlive(opt *dns.OPT) {
+	utils.RemoveEDNS0Option(opt, dns.EDNS0TCPKEEPALIVE)
+	// In a query, the timeout must be omitted.
+	// Note: dns.EDNS0_TCP_KEEPALIVE can't be packed/unpacked correctly
+	// by current version of miekg/dns, we use dns.EDNS0_LOCAL instead.
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE})
+}
+
+// handleReplyOptions adopts the keepalive timeout in r and removes the
+// options that are hop-by-hop or added by the Client from r.
+func (w *worker) handleReplyOptions(r *dns.Msg, optAdded bool) {
+	if opt := r.IsEdns0(); opt != nil && w.pool.edns0KeepAlive {
+		if o, ok := utils.GetEDNS0Option(opt, dns.EDNS0TCPKEEPALIVE).(*dns.EDNS0_LOCAL); ok && len(o.Data) == 2 {
+			// the timeout is in units of 100 milliseconds
+			timeout := time.Duration(binary.BigEndian.Uint16(o.Data)) * time.Millisecond * 100
+			w.serverAdvertised = true
+			w.idleTimeout = withMargin(timeout)
+			if w.idleTimeout == 0 {
+				w.pool.setIdleTimeout(closeImmediately)
+			} else {
+				w.pool.setIdleTimeout(w.idleTimeout)
+			}
+		}
+	}
+	w.pool.removeReplyOptions(r, optAdded)
+}
+
+// removeReplyOptions removes the options that are hop-by-hop or added by
+// the Client from r.
+func (p *Client) removeReplyOptions(r *dns.Msg, optAdded bool) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	if p.edns0KeepAlive {
+		utils.RemoveEDNS0Option(opt, dns.EDNS0TCPKEEPALIVE)
+	}
+	if p.paddingBlockSize > 0 {
+		utils.RemoveEDNS0Option(opt, dns.EDNS0PADDING)
+	}
+	if optAdded {
+		utils.RemoveEDNS0(r)
+	}
+}
@@ -0,0 +1,234 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package tcpClient
+
+import (
+	"context"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/utils"
+	"github.com/miekg/dns"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// keepAliveServer replies with a edns0 tcp keepalive timeout if the query has one.
+type keepAliveServer struct {
+	timeout uint16 // in units of 100 milliseconds
+}
+
+func (s *keepAliveServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	if opt := q.IsEdns0(); opt != nil && utils.GetEDNS0Option(opt, dns.EDNS0TCPKEEPALIVE) != nil {
+		rOpt, _ := utils.UpgradeEDNS0(r)
+		rOpt.Option = append(rOpt.Option, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: []byte{byte(s.timeout >> 8), byte(s.timeout)}})
+	}
+	w.WriteMsg(r)
+}
+
+func Test_EDNS0KeepAlive(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := dns.Server{Net: "tcp", Listener: l, Handler: &keepAliveServer{timeout: 50}}
+	go rs.ActivateAndServe()
+	defer rs.Shutdown()
+
+	dial := func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) }
+	c := New(context.Background(), dial, time.Second, time.Second, 0)
+	c.EnableEDNS0KeepAlive()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r, err := c.Query(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.IsEdns0() != nil {
+		t.Fatal("opt should be removed from the reply")
+	}
+	if q.IsEdns0() != nil {
+		t.Fatal("query was modified")
+	}
+	if want := withMargin(time.Second * 5); c.getIdleTimeout() != want {
+		t.Fatalf("want idle timeout %s, got %s", want, c.getIdleTimeout())
+	}
+}
+
+func Test_EDNS0KeepAlive_zeroTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := dns.Server{Net: "tcp", Listener: l, Handler: &keepAliveServer{timeout: 0}}
+	go rs.ActivateAndServe()
+	defer rs.Shutdown()
+
+	dial := func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) }
+	c := New(context.Background(), dial, time.Second, time.Second, time.Second*10)
+	c.EnableEDNS0KeepAlive()
+
+	for i := 0; i < 2; i++ {
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		if _, err := c.Query(context.Background(), q); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.getIdleTimeout(); got != 0 {
+			t.Fatalf("#%d: server asked to close connections, want idle timeout 0, got %s", i, got)
+		}
+	}
+}
+
+func Test_learnIdleTimeout(t *testing.T) {
+	c := New(context.Background(), nil, time.Second, time.Second, time.Second*10)
+	c.EnableEDNS0KeepAlive()
+
+	// resets and closes right after a reply say nothing about the timeout
+	c.learnIdleTimeout(time.Second*5, syscall.ECONNRESET)
+	c.learnIdleTimeout(time.Millisecond*10, io.EOF)
+	if got := c.getIdleTimeout(); got != time.Second*10 {
+		t.Fatalf("idle timeout should not be learned, got %s", got)
+	}
+
+	c.learnIdleTimeout(time.Second*5, io.EOF)
+	if want := withMargin(time.Second * 5); c.getIdleTimeout() != want {
+		t.Fatalf("want idle timeout %s, got %s", want, c.getIdleTimeout())
+	}
+	c.learnIdleTimeout(time.Second*2, io.EOF)
+	if got := c.getIdleTimeout(); got != minLearnedIdleTimeout {
+		t.Fatalf("want the floor %s, got %s", minLearnedIdleTimeout, got)
+	}
+
+	// connections that reach the learned timeout let it recover
+	for i := 0; i < 3; i++ {
+		c.growIdleTimeout()
+	}
+	if got := c.getIdleTimeout(); got != time.Second*10 {
+		t.Fatalf("want the idle timeout recovered to 10s, got %s", got)
+	}
+}
+
+// closeServer closes the connection right after the reply.
+type closeServer struct{}
+
+func (s *closeServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	r := new(dns.Msg)
+	r.SetReply(q)
+	w.WriteMsg(r)
+	w.Close()
+}
+
+func Test_EDNS0KeepAlive_closedAfterReply(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := dns.Server{Net: "tcp", Listener: l, Handler: &closeServer{}}
+	go rs.ActivateAndServe()
+	defer rs.Shutdown()
+
+	dial := func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) }
+	c := New(context.Background(), dial, time.Second, time.Second, time.Second*10)
+	c.EnableEDNS0KeepAlive()
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	if _, err := c.Query(context.Background(), q); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100) // wait for the worker to see the close
+	if got := c.getIdleTimeout(); got != time.Second*10 {
+		t.Fatalf("idle timeout should not be learned from a close after reply, got %s", got)
+	}
+}
+
+func Test_prepareQuery_paddingAndKeepAlive(t *testing.T) {
+	c := New(context.Background(), nil, time.Second, time.Second, 0)
+	c.EnableEDNS0KeepAlive()
+	c.EnablePadding(128)
+
+	for _, name := range []string{"a.com.", "a.very.very.very.very.very.long.long.long.long.name.example.com."} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+		m, optAdded := c.prepareQuery(q)
+		if !optAdded || q.IsEdns0() != nil {
+			t.Fatal("opt should be added to a copy of q")
+		}
+
+		b, err := m.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b)%128 != 0 {
+			t.Fatalf("%s: padded length %d is not a multiple of 128", name, len(b))
+		}
+		options := m.IsEdns0().Option
+		if len(options) != 2 || options[0].Option() != dns.EDNS0TCPKEEPALIVE || options[1].Option() != dns.EDNS0PADDING {
+			t.Fatalf("%s: want keepalive then padding, got %v", name, options)
+		}
+	}
+}
+
+// paddingServer records the wire length of queries and replies with a
+// padding option.
+type paddingServer struct {
+	qLen chan int
+}
+
+func (s *paddingServer) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
+	b, _ := q.Pack()
+	s.qLen <- len(b)
+	r := new(dns.Msg)
+	r.SetReply(q)
+	rOpt, _ := utils.UpgradeEDNS0(r)
+	rOpt.Option = append(rOpt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 16)})
+	w.WriteMsg(r)
+}
+
+func Test_Padding_noConnectionReuse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &paddingServer{qLen: make(chan int, 1)}
+	rs := dns.Server{Net: "tcp", Listener: l, Handler: s}
+	go rs.ActivateAndServe()
+	defer rs.Shutdown()
+
+	dial := func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) }
+	c := New(context.Background(), dial, time.Second, time.Second, 0)
+	c.EnablePadding(128)
+
+	q := new(dns.Msg)
+	q.SetQuestion("example.com.", dns.TypeA)
+	r, err := c.Query(context.Background(), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := <-s.qLen; n%128 != 0 {
+		t.Fatalf("query is not padded, length %d", n)
+	}
+	if r.IsEdns0() != nil {
+		t.Fatal("opt should be removed from the reply")
+	}
+}
@@ -0,0 +1,41 @@
+// +build linux
+
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package upstream
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const tfoSupported = true
+
+// setTFO enables TCP_FASTOPEN_CONNECT on the socket. The first write (e.g.
+// the tls client hello) will be sent with the SYN.
+// Requires linux 4.11+ and net.ipv4.tcp_fastopen & 1.
+func setTFO(_, _ string, c syscall.RawConn) error {
+	var err error
+	if cErr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+	}); cErr != nil {
+		return cErr
+	}
+	return err
+}
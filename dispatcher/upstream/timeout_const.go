@@ -26,4 +26,7 @@ const (
 	generalWriteTimeout = time.Second * 1
 	generalReadTimeout  = time.Second * 5
 	dohIOTimeout        = time.Second * 10
+
+	warmRetryMinInterval = time.Second
+	dohWarmInterval      = time.Second * 30
 )
@@ -0,0 +1,199 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package upstream
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"io/ioutil"
+	"strings"
+)
+
+// NewCertPool loads certificates from PEM files. If withSystem is true,
+// the certificates will be appended to a copy of the system pool.
+func NewCertPool(files []string, withSystem bool) (*x509.CertPool, error) {
+	var pool *x509.CertPool
+	if withSystem {
+		var err error
+		pool, err = x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("failed to load system cert pool: %w", err)
+		}
+	} else {
+		pool = x509.NewCertPool()
+	}
+
+	for _, f := range files {
+		pem, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("ReadFile: %w", err)
+		}
+
+		if ok := pool.AppendCertsFromPEM(pem); !ok {
+			return nil, fmt.Errorf("AppendCertsFromPEM: no certificate was successfully parsed in %s", f)
+		}
+	}
+	return pool, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// newTLSConfig builds a tls.Config from c. rootCAs is used if c doesn't
+// have its own CAs.
+func newTLSConfig(c *config.BasicUpstreamConfig, rootCAs *x509.CertPool) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		RootCAs:            rootCAs,
+		ClientSessionCache: tls.NewLRUClientSessionCache(64),
+		NextProtos:         c.TLS.ALPN,
+
+		// for test only
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if len(c.TLS.SessionFile) != 0 {
+		cache, err := getFileSessionCache(c.TLS.SessionFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load session file: %w", err)
+		}
+		tlsConf.ClientSessionCache = cache
+	}
+
+	if len(c.TLS.CA) != 0 || c.TLS.UseSystemCA {
+		pool, err := NewCertPool(c.TLS.CA, c.TLS.UseSystemCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ca: %w", err)
+		}
+		tlsConf.RootCAs = pool
+	}
+
+	switch {
+	case len(c.TLS.ClientCert) != 0 && len(c.TLS.ClientKey) != 0:
+		cert, err := tls.LoadX509KeyPair(c.TLS.ClientCert, c.TLS.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client cert: %w", err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	case len(c.TLS.ClientCert) != 0 || len(c.TLS.ClientKey) != 0:
+		return nil, errors.New("client cert and client key must be set together")
+	}
+
+	if len(c.TLS.MinVersion) != 0 {
+		v, ok := tlsVersions[c.TLS.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid tls min version [%s]", c.TLS.MinVersion)
+		}
+		tlsConf.MinVersion = v
+	}
+
+	if len(c.TLS.PinSHA256) != 0 || len(c.TLS.CertSHA256) != 0 {
+		pins, err := newPinSet(c.TLS.PinSHA256, c.TLS.CertSHA256, c.InsecureSkipVerify)
+		if err != nil {
+			return nil, err
+		}
+		tlsConf.VerifyConnection = pins.verify
+	}
+
+	return tlsConf, nil
+}
+
+// pinSet checks server certificates against a list of fingerprints.
+// It is called after the normal certificate verification and also on
+// resumed connections, so pinning still works if InsecureSkipVerify is
+// set (e.g. a self-signed server).
+type pinSet struct {
+	spki [][]byte
+	cert [][]byte
+
+	// insecure means the chain is not verified, only the leaf can be trusted.
+	insecure bool
+}
+
+func newPinSet(spki, cert []string, insecure bool) (*pinSet, error) {
+	ps := &pinSet{insecure: insecure}
+	for _, s := range spki {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, "sha256//"))
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid spki pin [%s]", s)
+		}
+		ps.spki = append(ps.spki, b)
+	}
+	for _, s := range cert {
+		b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid cert fingerprint [%s]", s)
+		}
+		ps.cert = append(ps.cert, b)
+	}
+	return ps, nil
+}
+
+// verify reports an error if none of the trusted certificates matches the pins.
+// Peers can send extra certificates that are not part of the verified chain,
+// so only certificates in cs.VerifiedChains are checked. If the chain is not
+// verified, only the leaf is checked.
+func (ps *pinSet) verify(cs tls.ConnectionState) error {
+	var certs []*x509.Certificate
+	switch {
+	case ps.insecure:
+		if len(cs.PeerCertificates) != 0 {
+			certs = cs.PeerCertificates[:1]
+		}
+	default:
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+	}
+
+	for _, cert := range certs {
+		if len(ps.cert) != 0 {
+			sum := sha256.Sum256(cert.Raw)
+			if containsBytes(ps.cert, sum[:]) {
+				return nil
+			}
+		}
+
+		if len(ps.spki) != 0 {
+			sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if containsBytes(ps.spki, sum[:]) {
+				return nil
+			}
+		}
+	}
+	return errors.New("no server certificate matches the pinned fingerprints")
+}
+
+func containsBytes(list [][]byte, b []byte) bool {
+	for i := range list {
+		if bytes.Equal(list[i], b) {
+			return true
+		}
+	}
+	return false
+}
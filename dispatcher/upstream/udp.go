@@ -50,7 +50,7 @@ func (u *udpUpstream) exchange(ctx context.Context, q *dns.Msg) (r *dns.Msg, err
 	}
 
 	if c := u.cp.Get(); c != nil {
-		r, err := u.exchangeViaUDPConn(q, c)
+		r, err := u.exchangeViaUDPConn(ctx, q, c)
 		if err != nil {
 			c.Close()
 			if contextIsDone(ctx) == true {
@@ -76,7 +76,7 @@ exchangeViaNewConn:
 		return nil, ctx.Err()
 	}
 
-	r, err = u.exchangeViaUDPConn(q, c)
+	r, err = u.exchangeViaUDPConn(ctx, q, c)
 	if err != nil {
 		c.Close()
 		return nil, err
@@ -86,13 +86,19 @@ exchangeViaNewConn:
 	return r, nil
 }
 
-func (u *udpUpstream) exchangeViaUDPConn(q *dns.Msg, c net.Conn) (r *dns.Msg, err error) {
+// exchangeViaUDPConn waits for the reply until ctx's deadline or
+// generalReadTimeout, whichever is earlier.
+func (u *udpUpstream) exchangeViaUDPConn(ctx context.Context, q *dns.Msg, c net.Conn) (r *dns.Msg, err error) {
 	c.SetWriteDeadline(time.Now().Add(generalWriteTimeout))
 	_, err = utils.WriteMsgToUDP(c, q)
 	if err != nil { // write err typically is a fatal err
 		return nil, fmt.Errorf("failed to write msg: %w", err)
 	}
-	c.SetReadDeadline(time.Now().Add(generalReadTimeout))
+	readDeadline := time.Now().Add(generalReadTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(readDeadline) {
+		readDeadline = d
+	}
+	c.SetReadDeadline(readDeadline)
 
 	for {
 		r, _, err = utils.ReadMsgFromUDP(c, utils.IPv4UdpMaxPayload)
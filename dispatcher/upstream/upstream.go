@@ -19,11 +19,11 @@ package upstream
 
 import (
 	"context"
-	"crypto/tls"
 	"crypto/x509"
 	"fmt"
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/ecs"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/upstream/tcp_client"
 	"github.com/IrineSistiana/mos-chinadns/dispatcher/utils"
 	"github.com/miekg/dns"
 	"golang.org/x/sync/singleflight"
@@ -41,6 +41,8 @@ type BasicUpstream struct {
 			ipv4, ipv6 *dns.EDNS0_SUBNET
 		}
 		overwriteECS bool
+
+		paddingBlockSize int // 0 means no padding
 	}
 	deduplicate bool
 
@@ -95,6 +97,17 @@ func (u *BasicUpstream) exchange(ctx context.Context, q *dns.Msg) (r *dns.Msg, e
 		}
 	}
 
+	if u.edns0.paddingBlockSize > 0 {
+		var optAdded bool
+		q, optAdded = padQuery(q, u.edns0.paddingBlockSize)
+		r, err = u.backend.Exchange(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		unpadReply(r, optAdded)
+		return r, nil
+	}
+
 	return u.backend.Exchange(ctx, q)
 }
 
@@ -116,48 +129,68 @@ func getMsgKey(m *dns.Msg) (string, error) {
 }
 
 func NewUpstreamServer(c *config.BasicUpstreamConfig, rootCAs *x509.CertPool) (Upstream, error) {
+	if c.FastOpen {
+		switch {
+		case !tfoSupported:
+			return nil, fmt.Errorf("tcp fast open is not supported on this platform")
+		case len(c.Socks5) != 0:
+			return nil, fmt.Errorf("tcp fast open can not be used with socks5")
+		}
+	}
+
 	var backend Upstream
 	switch c.Protocol {
 	case "udp", "":
 		backend = NewUDPUpstream(c.Addr)
 
 	case "tcp":
-		backend = NewTCPUpstream(c.Addr, c.Socks5, time.Duration(c.TCP.IdleTimeout)*time.Second)
+		tcpU := newTCPUpstream(c.Addr, c.Socks5, time.Duration(c.TCP.IdleTimeout)*time.Second, false, nil)
+		tcpU.fastOpen = c.FastOpen
+		if err := setupTCPClient(tcpU.cp, c); err != nil {
+			return nil, err
+		}
+		backend = tcpU
 
 	case "dot":
 		if len(c.DoT.ServerName) == 0 {
 			return nil, fmt.Errorf("dot server needs a server name")
 		}
-		tlsConf := &tls.Config{
-			ServerName:         c.DoT.ServerName,
-			RootCAs:            rootCAs,
-			ClientSessionCache: tls.NewLRUClientSessionCache(64),
-
-			// for test only
-			InsecureSkipVerify: c.InsecureSkipVerify,
+		tlsConf, err := newTLSConfig(c, rootCAs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls config: %w", err)
 		}
+		tlsConf.ServerName = c.DoT.ServerName
 
-		backend = NewDoTUpstream(c.Addr, c.Socks5, time.Duration(c.DoT.IdleTimeout)*time.Second, tlsConf)
+		dotU := newTCPUpstream(c.Addr, c.Socks5, time.Duration(c.DoT.IdleTimeout)*time.Second, true, tlsConf)
+		dotU.fastOpen = c.FastOpen
+		if err := setupTCPClient(dotU.cp, c); err != nil {
+			return nil, err
+		}
+		backend = dotU
 
 	case "doh":
 		if len(c.DoH.URL) == 0 {
 			return nil, fmt.Errorf("protocol [%s] needs additional argument: url", c.Protocol)
 		}
 
-		tlsConf := &tls.Config{
-			// don't have to set servername here, net.http will do it itself.
-			RootCAs:            rootCAs,
-			ClientSessionCache: tls.NewLRUClientSessionCache(64),
-
-			// for test only
-			InsecureSkipVerify: c.InsecureSkipVerify,
+		// don't have to set servername here, net.http will do it itself.
+		tlsConf, err := newTLSConfig(c, rootCAs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls config: %w", err)
 		}
 
-		var err error
-		backend, err = NewDoHUpstream(c.DoH.URL, c.Addr, c.Socks5, tlsConf)
+		dohU, err := newDoHUpstream(c.DoH.URL, c.Addr, c.Socks5, c.FastOpen, tlsConf)
 		if err != nil {
 			return nil, fmt.Errorf("failed to init DoH: %w", err)
 		}
+		if c.Warm.Conns > 0 {
+			interval := dohWarmInterval
+			if c.Warm.Interval > 0 {
+				interval = time.Duration(c.Warm.Interval) * time.Second
+			}
+			dohU.KeepWarm(interval)
+		}
+		backend = dohU
 
 	default:
 		return nil, fmt.Errorf("unsupport protocol: %s", c.Protocol)
@@ -183,7 +216,36 @@ func NewUpstreamServer(c *config.BasicUpstreamConfig, rootCAs *x509.CertPool) (U
 	}
 	u.edns0.overwriteECS = c.EDNS0.OverwriteECS
 
+	if c.EDNS0.Padding {
+		if c.Protocol != "dot" && c.Protocol != "doh" {
+			return nil, fmt.Errorf("padding is only supported by dot and doh")
+		}
+		blockSize := defaultPaddingBlockSize
+		if c.EDNS0.PaddingBlockSize > 0 {
+			blockSize = c.EDNS0.PaddingBlockSize
+		}
+		// the tcp client adds its own options, so it pads queries itself.
+		if tcpU, ok := backend.(*tcpUpstream); ok {
+			tcpU.cp.EnablePadding(blockSize)
+		} else {
+			u.edns0.paddingBlockSize = blockSize
+		}
+	}
+
 	u.deduplicate = c.Deduplicate
 
 	return u, nil
 }
+
+func setupTCPClient(cp *tcpClient.Client, c *config.BasicUpstreamConfig) error {
+	if c.EDNS0.TCPKeepAlive {
+		cp.EnableEDNS0KeepAlive()
+	}
+
+	if c.Warm.Conns > 0 {
+		if err := cp.KeepWarm(c.Warm.Conns); err != nil {
+			return fmt.Errorf("can not keep warm connections, %w, please set a idle_timeout", err)
+		}
+	}
+	return nil
+}
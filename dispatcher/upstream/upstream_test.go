@@ -22,9 +22,12 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -32,6 +35,8 @@ import (
 	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"reflect"
 	"sync"
 	"testing"
@@ -76,6 +81,35 @@ func Test_tcp_upstream(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func Test_tcp_upstream_warm(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	rs := dns.Server{Net: "tcp", Listener: l, Handler: dummyServer}
+	go rs.ActivateAndServe()
+	defer rs.Shutdown()
+
+	u := newTCPUpstream(addr, "", time.Second*5, false, nil)
+	if err := u.cp.KeepWarm(2); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for u.cp.Workers() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("want 2 warm connections, got %d", u.cp.Workers())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if err := testUpstream(u); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func Test_dot_upstream(t *testing.T) {
 	cert, err := generateCertificate()
 	tlsConfig := new(tls.Config)
@@ -95,11 +129,270 @@ func Test_dot_upstream(t *testing.T) {
 	}
 }
 
+func Test_dot_upstream_pin(t *testing.T) {
+	cert, err := generateCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := new(tls.Config)
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	tlsListener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := tlsListener.Addr().String()
+	rs := dns.Server{Net: "tcp-tls", Listener: tlsListener, TLSConfig: tlsConfig, Handler: dummyServer}
+	go rs.ActivateAndServe()
+	defer rs.Shutdown()
+
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	spki := sha256.Sum256(x509Cert.RawSubjectPublicKeyInfo)
+	certSum := sha256.Sum256(cert.Certificate[0])
+	wrong := sha256.Sum256([]byte("wrong"))
+
+	tests := []struct {
+		name    string
+		spki    []string
+		cert    []string
+		wantErr bool
+	}{
+		{"spki pin", []string{base64.StdEncoding.EncodeToString(spki[:])}, nil, false},
+		{"cert pin", nil, []string{hex.EncodeToString(certSum[:])}, false},
+		{"wrong pin", []string{base64.StdEncoding.EncodeToString(wrong[:])}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ps, err := newPinSet(tt.spki, tt.cert, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u := NewDoTUpstream(addr, "", 0, &tls.Config{InsecureSkipVerify: true, VerifyConnection: ps.verify})
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			_, err = u.Exchange(context.Background(), q)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Exchange() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// The peer sends its own leaf with the pinned certificate appended.
+// The pinned certificate is not part of the verified chain, so the
+// handshake must fail.
+func Test_pinSet_extraCerts(t *testing.T) {
+	pinned, err := generateCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	attacker, err := generateCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := new(tls.Config)
+	tlsConfig.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{attacker.Certificate[0], pinned.Certificate[0]},
+		PrivateKey:  attacker.PrivateKey,
+	}}
+	tlsListener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := tlsListener.Addr().String()
+	rs := dns.Server{Net: "tcp-tls", Listener: tlsListener, TLSConfig: tlsConfig, Handler: dummyServer}
+	go rs.ActivateAndServe()
+	defer rs.Shutdown()
+
+	pinnedCert, err := x509.ParseCertificate(pinned.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	attackerCert, err := x509.ParseCertificate(attacker.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	spki := sha256.Sum256(pinnedCert.RawSubjectPublicKeyInfo)
+	certSum := sha256.Sum256(pinned.Certificate[0])
+	spkiPins := []string{base64.StdEncoding.EncodeToString(spki[:])}
+	certPins := []string{hex.EncodeToString(certSum[:])}
+
+	// the attacker's leaf is trusted, like a mis-issued certificate
+	roots := x509.NewCertPool()
+	roots.AddCert(attackerCert)
+
+	for _, insecure := range []bool{true, false} {
+		ps, err := newPinSet(spkiPins, certPins, insecure)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conf := &tls.Config{ServerName: "example.com", RootCAs: roots, InsecureSkipVerify: insecure, VerifyConnection: ps.verify}
+		conn, err := tls.Dial("tcp", addr, conf)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("insecure %v: handshake should fail if the pinned cert is not in the verified chain", insecure)
+		}
+	}
+
+	// the leaf itself can still be pinned
+	leafSum := sha256.Sum256(attacker.Certificate[0])
+	ps, err := newPinSet(nil, []string{hex.EncodeToString(leafSum[:])}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "example.com", RootCAs: roots, VerifyConnection: ps.verify})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func Test_padQuery(t *testing.T) {
+	for _, name := range []string{"a.com.", "example.com.", "a.very.very.very.very.very.long.long.long.long.name.example.com."} {
+		q := new(dns.Msg)
+		q.SetQuestion(name, dns.TypeA)
+
+		padded, optAdded := padQuery(q, defaultPaddingBlockSize)
+		if !optAdded {
+			t.Fatal("opt should be added")
+		}
+		if q.IsEdns0() != nil {
+			t.Fatal("q was modified")
+		}
+		b, err := padded.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b)%defaultPaddingBlockSize != 0 {
+			t.Fatalf("%s: padded length %d is not a multiple of %d", name, len(b), defaultPaddingBlockSize)
+		}
+
+		unpadReply(padded, optAdded)
+		if padded.IsEdns0() != nil {
+			t.Fatal("opt should be removed")
+		}
+	}
+}
+
+func Test_fileSessionCache(t *testing.T) {
+	cert, err := generateCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := new(tls.Config)
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	tlsListener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := tlsListener.Addr().String()
+	rs := dns.Server{Net: "tcp-tls", Listener: tlsListener, TLSConfig: tlsConfig, Handler: dummyServer}
+	go rs.ActivateAndServe()
+	defer rs.Shutdown()
+
+	file := filepath.Join(t.TempDir(), "session")
+	query := func() (resumed bool) {
+		cache, err := newFileSessionCache(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ClientSessionCache: cache})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// read a reply, so the client can receive the session ticket.
+		q := new(dns.Msg)
+		q.SetQuestion("example.com.", dns.TypeA)
+		dc := dns.Conn{Conn: conn}
+		if err := dc.WriteMsg(q); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := dc.ReadMsg(); err != nil {
+			t.Fatal(err)
+		}
+		if err := cache.flush(); err != nil {
+			t.Fatal(err)
+		}
+		return conn.ConnectionState().DidResume
+	}
+
+	if query() {
+		t.Fatal("first connection should not be resumed")
+	}
+	if !query() {
+		t.Fatal("second connection should be resumed from the session file")
+	}
+}
+
+func Test_getFileSessionCache(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "session")
+	c1, err := getFileSessionCache(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := getFileSessionCache(file + string(filepath.Separator))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c1 != c2 {
+		t.Fatal("servers with the same session file should share one cache")
+	}
+}
+
 // TODO: add test for doh
 //func Test_doh_upstream(t *testing.T) {
 //
 //}
 
+// Test_upstream_ctxDeadline tests that udp and doh upstreams give up when
+// ctx is done instead of waiting for their own timeouts.
+func Test_upstream_ctxDeadline(t *testing.T) {
+	// a udp server that never replies
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	// a doh server that never replies
+	hs := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second * 5):
+		}
+	}))
+	hs.EnableHTTP2 = true
+	hs.StartTLS()
+	defer hs.Close()
+	dohU, err := newDoHUpstream(hs.URL+"/dns-query", hs.Listener.Addr().String(), "", false, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, u := range map[string]Upstream{
+		"udp": NewUDPUpstream(udpConn.LocalAddr().String()),
+		"doh": dohU,
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+			defer cancel()
+			q := new(dns.Msg)
+			q.SetQuestion("example.com.", dns.TypeA)
+			start := time.Now()
+			if _, err := u.Exchange(ctx, q); err == nil {
+				t.Fatal("want a timeout error")
+			}
+			if d := time.Since(start); d > time.Second {
+				t.Fatalf("Exchange returned after %s, ctx deadline is ignored", d)
+			}
+		})
+	}
+}
+
 func Test_http2_t1_transport(t *testing.T) {
 	t1 := &http.Transport{
 		DisableKeepAlives:     false,
@@ -19,12 +19,111 @@ package upstream
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/logger"
 	"github.com/miekg/dns"
 	"golang.org/x/net/proxy"
 	"net"
+	"sync/atomic"
+	"time"
 )
 
+// dialTCP dials a tcp connection to addr. If socks5 is not empty, the
+// connection will be dialed via the socks5 proxy and fastOpen is ignored.
+func dialTCP(ctx context.Context, addr, socks5 string, fastOpen bool) (c net.Conn, err error) {
+	if len(socks5) != 0 {
+		c, err = dialTCPViaSocks5(ctx, "tcp", addr, socks5)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dial socks5 connection: %w", err)
+		}
+		return c, nil
+	}
+
+	d := net.Dialer{}
+	if fastOpen {
+		d.Control = setTFO
+	}
+	start := time.Now()
+	c, err = d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial tcp connection: %w", err)
+	}
+	if fastOpen { // the handshake is sent with the first write, there is nothing to measure yet
+		logger.GetStd().Debugf("dialTCP: %s dialed with tfo", addr)
+	} else {
+		logger.GetStd().Debugf("dialTCP: %s connected in %dms", addr, time.Since(start).Milliseconds())
+	}
+	return c, nil
+}
+
+// ErrTLSHandshake is the error (wrapped) returned by upstreams if the tls
+// handshake failed.
+var ErrTLSHandshake = errors.New("tls handshake failed")
+
+type tlsHandshakeError struct {
+	err error
+}
+
+func (e *tlsHandshakeError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrTLSHandshake, e.err)
+}
+
+func (e *tlsHandshakeError) Unwrap() error {
+	return e.err
+}
+
+func (e *tlsHandshakeError) Is(target error) bool {
+	return target == ErrTLSHandshake
+}
+
+// tlsHandshake upgrades c to a tls connection. stats can be nil.
+func tlsHandshake(c net.Conn, conf *tls.Config, stats *handshakeStats) (*tls.Conn, error) {
+	tlsConn := tls.Client(c, conf)
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	start := time.Now()
+	// handshake now
+	if err := tlsConn.Handshake(); err != nil {
+		tlsConn.Close()
+		return nil, &tlsHandshakeError{err: err}
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	d := time.Since(start)
+	resumed := tlsConn.ConnectionState().DidResume
+	if stats != nil {
+		saved := stats.record(d, resumed)
+		logger.GetStd().Debugf("tlsHandshake: %s handshake finished in %dms, resumed: %v, saved: %dms", c.RemoteAddr(), d.Milliseconds(), resumed, saved.Milliseconds())
+	}
+	return tlsConn, nil
+}
+
+// handshakeStats records the average time of full tls handshakes,
+// so we can tell how much time a resumed handshake saved.
+type handshakeStats struct {
+	full int64 // time.Duration, atomic
+}
+
+// record records d and returns the time a resumed handshake saved.
+func (s *handshakeStats) record(d time.Duration, resumed bool) (saved time.Duration) {
+	avg := time.Duration(atomic.LoadInt64(&s.full))
+	if resumed {
+		if avg > d {
+			return avg - d
+		}
+		return 0
+	}
+
+	if avg == 0 {
+		avg = d
+	} else {
+		avg = avg - avg/8 + d/8
+	}
+	atomic.StoreInt64(&s.full, int64(avg))
+	return 0
+}
+
 func dialTCPViaSocks5(ctx context.Context, network, addr, socks5 string) (c net.Conn, err error) {
 	socks5Dialer, err := proxy.SOCKS5(network, socks5, nil, nil)
 	if err != nil {
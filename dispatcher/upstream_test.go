@@ -16,3 +16,199 @@
 //     along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
 package dispatcher
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/policy"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/upstream"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func Test_msgIPs_finalName(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("a.example.", dns.TypeA)
+	m.Answer = []dns.RR{
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "a.example.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET}, Target: "b.example."},
+		&dns.A{Hdr: dns.RR_Header{Name: "b.example.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP("1.1.1.1")},
+		&dns.CNAME{Hdr: dns.RR_Header{Name: "b.example.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET}, Target: "C.example."},
+		&dns.A{Hdr: dns.RR_Header{Name: "c.example.", Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.ParseIP("2.2.2.2")},
+	}
+
+	if got := finalName(m, "a.example."); got != "C.example." {
+		t.Fatalf("want final name C.example., got %s", got)
+	}
+	if ips := msgIPs(m, ""); len(ips) != 2 {
+		t.Fatalf("want 2 ips, got %v", ips)
+	}
+	if ips := msgIPs(m, finalName(m, "a.example.")); len(ips) != 1 || !ips[0].Equal(net.ParseIP("2.2.2.2")) {
+		t.Fatalf("want 2.2.2.2, got %v", ips)
+	}
+}
+
+// funcUpstream is an upstream that calls itself.
+type funcUpstream func(ctx context.Context, q *dns.Msg) (*dns.Msg, error)
+
+func (f funcUpstream) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	return f(ctx, q)
+}
+
+func Test_upstreamEntry_errorPolicy(t *testing.T) {
+	fallbackIP := net.ParseIP("8.8.8.8")
+	servers := map[string]upstream.Upstream{"fallback": &fakeUpstream{ip: fallbackIP}}
+
+	withRcode := func(rcode int) funcUpstream {
+		return func(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+			r := new(dns.Msg)
+			r.SetRcode(q, rcode)
+			return r, nil
+		}
+	}
+	withErr := func(err error) funcUpstream {
+		return func(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+			return nil, err
+		}
+	}
+	blocked := funcUpstream(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	tests := []struct {
+		name      string
+		errPolicy map[string]string
+		backend   upstream.Upstream
+		wantIP    net.IP // nil means no redirect
+		wantRcode int
+		wantErr   bool
+	}{
+		{"timeout", map[string]string{"timeout": "Redirect_fallback"}, blocked, fallbackIP, dns.RcodeSuccess, false},
+		{"conn refused", map[string]string{"conn_refused": "Redirect_fallback"}, withErr(&net.OpError{Op: "read", Err: syscall.ECONNREFUSED}), fallbackIP, dns.RcodeSuccess, false},
+		{"tls", map[string]string{"tls": "Redirect_fallback"}, withErr(fmt.Errorf("dial: %w", upstream.ErrTLSHandshake)), fallbackIP, dns.RcodeSuccess, false},
+		{"tls not matched", map[string]string{"timeout": "Redirect_fallback"}, withErr(fmt.Errorf("dial: %w", upstream.ErrTLSHandshake)), nil, 0, true},
+		{"invalid action", map[string]string{"other": "not_an_action"}, nil, nil, 0, true},
+		{"servfail", map[string]string{"servfail": "Redirect_fallback"}, withRcode(dns.RcodeServerFailure), fallbackIP, dns.RcodeSuccess, false},
+		{"nxdomain", map[string]string{"servfail": "Redirect_fallback"}, withRcode(dns.RcodeNameError), nil, dns.RcodeNameError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &Dispatcher{servers: servers}
+			uc := &config.UpstreamEntryConfig{ServerTag: "fallback", Timeout: 50}
+			uc.Policies.Error = tt.errPolicy
+			u, err := d.newEntry(tt.name, uc)
+			if tt.backend == nil {
+				if err == nil {
+					t.Fatal("invalid policy should be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			u.backend = tt.backend
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			r, err := u.Exchange(ctx, newTestQuery(), nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Rcode != tt.wantRcode {
+				t.Fatalf("want rcode %d, got %d", tt.wantRcode, r.Rcode)
+			}
+			if tt.wantIP != nil && (len(r.Answer) == 0 || !r.Answer[0].(*dns.A).A.Equal(tt.wantIP)) {
+				t.Fatalf("want redirected reply, got %v", r.Answer)
+			}
+		})
+	}
+}
+
+func Test_upstreamEntry_errorRcode(t *testing.T) {
+	p, err := policy.NewRcodePolicies("accept:NXDOMAIN|deny", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		rcode    int
+		accepted bool
+	}{
+		{dns.RcodeNameError, true},
+		{dns.RcodeServerFailure, false},
+		{dns.RcodeRefused, false},
+	} {
+		rcode := tt.rcode
+		u := &upstreamEntry{backend: funcUpstream(func(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+			r := new(dns.Msg)
+			r.SetRcode(q, rcode)
+			return r, nil
+		})}
+		u.policies.reply.errorRcode = p
+
+		r, err := u.Exchange(context.Background(), newTestQuery(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (r != nil) != tt.accepted {
+			t.Fatalf("rcode %s: want accepted %v, got reply %v", dns.RcodeToString[rcode], tt.accepted, r)
+		}
+	}
+}
+
+func newTestQuery() *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	return m
+}
+
+func Test_upstreamEntry_bogusIP(t *testing.T) {
+	servers := map[string]upstream.Upstream{"bogus": &fakeUpstream{ip: net.ParseIP("243.185.187.39")}, "good": &fakeUpstream{ip: net.ParseIP("1.1.1.1")}}
+	for _, tt := range []struct {
+		server    string
+		policy    string
+		wantRcode int
+		wantNil   bool
+	}{
+		{"bogus", "nxdomain", dns.RcodeNameError, false},
+		{"bogus", "deny", 0, true},
+		{"bogus", "Redirect_good", dns.RcodeSuccess, false},
+		{"good", "nxdomain", dns.RcodeSuccess, false},
+	} {
+		d := &Dispatcher{servers: servers, synth: newSynthesizer(new(config.Config))}
+		uc := &config.UpstreamEntryConfig{ServerTag: tt.server}
+		uc.Policies.Reply.BogusIP.Rules = []*config.PolicyRule{{Action: tt.policy, CIDRs: []string{"243.185.187.39/32"}}}
+		u, err := d.newEntry("test", uc)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := u.Exchange(context.Background(), newTestQuery(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.wantNil {
+			if r != nil {
+				t.Fatalf("%s %s: want no reply, got %v", tt.server, tt.policy, r)
+			}
+			continue
+		}
+		if r.Rcode != tt.wantRcode {
+			t.Fatalf("%s %s: want rcode %d, got %d", tt.server, tt.policy, tt.wantRcode, r.Rcode)
+		}
+		if tt.wantRcode == dns.RcodeSuccess && r.Answer[0].(*dns.A).A.Equal(net.ParseIP("243.185.187.39")) {
+			t.Fatalf("%s %s: bogus reply is accepted", tt.server, tt.policy)
+		}
+	}
+}
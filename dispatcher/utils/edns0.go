@@ -0,0 +1,87 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package utils
+
+import "github.com/miekg/dns"
+
+const (
+	// EDNS0UDPSize is the udp size of OPTs created by UpgradeEDNS0.
+	EDNS0UDPSize = 1480
+)
+
+// UpgradeEDNS0 returns m's OPT. If m doesn't have one, a new OPT will be
+// appended to m and isNew will be true.
+func UpgradeEDNS0(m *dns.Msg) (opt *dns.OPT, isNew bool) {
+	if opt := m.IsEdns0(); opt != nil {
+		return opt, false
+	}
+
+	opt = new(dns.OPT)
+	opt.SetUDPSize(EDNS0UDPSize)
+	opt.Hdr.Name = "."
+	opt.Hdr.Rrtype = dns.TypeOPT
+	m.Extra = append(m.Extra, opt)
+	return opt, true
+}
+
+// GetEDNS0Option returns the first option in opt that has the code.
+func GetEDNS0Option(opt *dns.OPT, code uint16) dns.EDNS0 {
+	for _, o := range opt.Option {
+		if o.Option() == code {
+			return o
+		}
+	}
+	return nil
+}
+
+// RemoveEDNS0Option removes all options in opt that have the code.
+func RemoveEDNS0Option(opt *dns.OPT, code uint16) {
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != code {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// RemoveEDNS0 removes the OPT from m.
+func RemoveEDNS0(m *dns.Msg) {
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
+
+// PadEDNS0 pads m to a multiple of blockSize (RFC 7830). opt is m's OPT.
+// The padding option is moved to the end of opt, so it must be called
+// after all other options are added.
+func PadEDNS0(m *dns.Msg, opt *dns.OPT, blockSize int) {
+	RemoveEDNS0Option(opt, dns.EDNS0PADDING)
+
+	// padding must be the last option
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, padding)
+
+	if l := m.Len() % blockSize; l != 0 {
+		padding.Padding = make([]byte, blockSize-l)
+	}
+}
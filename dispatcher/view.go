@@ -0,0 +1,141 @@
+//     Copyright (C) 2020, IrineSistiana
+//
+//     This file is part of mos-chinadns.
+//
+//     mos-chinadns is free software: you can redistribute it and/or modify
+//     it under the terms of the GNU General Public License as published by
+//     the Free Software Foundation, either version 3 of the License, or
+//     (at your option) any later version.
+//
+//     mos-chinadns is distributed in the hope that it will be useful,
+//     but WITHOUT ANY WARRANTY; without even the implied warranty of
+//     MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+//     GNU General Public License for more details.
+//
+//     You should have received a copy of the GNU General Public License
+//     along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dispatcher
+
+import (
+	"context"
+	"fmt"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/config"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/ecs"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/ipset"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/logger"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/matcher/netlist"
+	"github.com/IrineSistiana/mos-chinadns/dispatcher/server"
+	"github.com/miekg/dns"
+)
+
+// profile is a set of upstream entries and ipset rules.
+type profile struct {
+	entriesSlice []*upstreamEntry // sorted by priority
+	ipsetHandler *ipset.Handler
+}
+
+// newProfile inits a profile. Entry names will have the prefix.
+func (d *Dispatcher) newProfile(prefix string, c *config.ProfileConfig) (*profile, error) {
+	upstreams := c.Upstream
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream")
+	}
+
+	p := new(profile)
+	p.entriesSlice = make([]*upstreamEntry, 0, len(upstreams))
+	for name := range upstreams {
+		u, err := d.newEntry(prefix+name, upstreams[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to init upstream %s: %w", name, err)
+		}
+		p.entriesSlice = append(p.entriesSlice, u)
+	}
+	sortEntries(p.entriesSlice)
+
+	handler, err := ipset.NewIPSetHandler(&c.IPSet)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init ipset handler: %w", err)
+	}
+	p.ipsetHandler = handler
+	return p, nil
+}
+
+// view is a profile for a group of clients.
+type view struct {
+	name    string
+	clients netlist.MatcherGroup
+	*profile
+}
+
+func (d *Dispatcher) newView(c *config.ViewConfig) (*view, error) {
+	if len(c.Name) == 0 {
+		return nil, fmt.Errorf("view has no name")
+	}
+	if len(c.Client) == 0 {
+		return nil, fmt.Errorf("view %s has no client", c.Name)
+	}
+
+	v := new(view)
+	v.name = c.Name
+	clients, err := loadIPMatchers(c.Client)
+	if err != nil {
+		return nil, fmt.Errorf("view %s: %w", c.Name, err)
+	}
+	v.clients = clients
+
+	v.profile, err = d.newProfile(c.Name+"/", &c.ProfileConfig)
+	if err != nil {
+		return nil, fmt.Errorf("view %s: %w", c.Name, err)
+	}
+	return v, nil
+}
+
+func loadIPMatchers(files []string) (netlist.MatcherGroup, error) {
+	ms := make(netlist.MatcherGroup, 0, len(files))
+	for _, file := range files {
+		m, err := netlist.NewIPMatcherFromFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ip file from %s, %w", file, err)
+		}
+		ms = append(ms, m)
+	}
+	return ms, nil
+}
+
+// profileHandler serves queries with a fixed profile.
+type profileHandler struct {
+	d *Dispatcher
+	p *profile
+}
+
+func (h *profileHandler) ServeDNS(ctx context.Context, q *dns.Msg, meta *server.RequestMeta) (*dns.Msg, error) {
+	return h.d.serveDNS(ctx, h.p, q, meta)
+}
+
+// selectProfile returns the profile of the first view that matches the
+// client. If no view matches, the default profile will be returned.
+func (d *Dispatcher) selectProfile(q *dns.Msg, meta *server.RequestMeta) *profile {
+	if len(d.views) == 0 {
+		return &d.profile
+	}
+
+	clientIP := meta.ClientIP()
+	if clientIP == nil {
+		return &d.profile
+	}
+
+	if d.trustedECS.Match(clientIP) {
+		if e := ecs.GetECS(q); e != nil {
+			clientIP = e.Address
+		}
+	}
+
+	for _, v := range d.views {
+		if v.clients.Match(clientIP) {
+			logger.GetStd().Debugf("Dispatch: [%v %d]: client %s matched view %s", q.Question, q.Id, clientIP, v.name)
+			return v.profile
+		}
+	}
+	return &d.profile
+}